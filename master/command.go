@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// A command is an operator command typed on standard input as /name args.
+type command struct {
+	args string // argument synopsis, for help
+	help string
+	run  func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	// Assigned in init to break the initialization cycle through cmdHelp.
+	commands = map[string]command{
+		"help":       {"", "list the commands", cmdHelp},
+		"peers":      {"", "list the peer registry and the state of each connection", cmdPeers},
+		"connect":    {"host:port", "connect to a peer", cmdConnect},
+		"disconnect": {"host:port", "close the connections to and from a peer", cmdDisconnect},
+		"ban":        {"[host:port [duration] [reason]]", "ban a peer for -bantime or the given duration, or list the bans", cmdBan},
+		"unban":      {"host:port", "lift the ban of a peer", cmdUnban},
+		"nick":       {"[name]", "show or set the nickname attached to your messages", cmdNick},
+		"msg":        {"host:port|nick|id text", "send a direct message to a peer, or to any node through the routing table", cmdMsg},
+		"routes":     {"", "list the routing table used for direct messages", cmdRoutes},
+		"send-file":  {"path", "share a file of up to 1MB with the mesh", cmdSendFile},
+		"urgent":     {"text", "send a message that overtakes the others queued for each peer", cmdUrgent},
+		"history":    {"", "show the recent messages", cmdHistory},
+		"roster":     {"", "list the nodes in the mesh and when they were last heard from", cmdRoster},
+		"stats":      {"", "show message counters", cmdStats},
+		"quit":       {"", "exit", cmdQuit},
+	}
+}
+
+// readInput reads lines from standard input. Lines starting with a slash are
+// commands; any other line is sent to the mesh as a message.
+func readInput() {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			fatal("reading input failed", util.LogErr, err)
+		}
+		line := editLine(strings.TrimSuffix(s, "\n"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "//"):
+			node.Send(line[1:]) // Escaped slash.
+		case strings.HasPrefix(line, "/"):
+			runCommand(line[1:])
+		default:
+			node.Send(line)
+		}
+	}
+}
+
+// editLine applies the line-editing characters that a terminal passed through
+// instead of interpreting: backspace and delete erase the previous
+// character, ^W the previous word and ^U the whole line. Other control
+// characters, tabs included, are dropped.
+func editLine(s string) string {
+	var b []rune
+	for _, r := range s {
+		switch {
+		case r == '\b' || r == 0x7f:
+			if len(b) > 0 {
+				b = b[:len(b)-1]
+			}
+		case r == 0x17: // ^W
+			for len(b) > 0 && b[len(b)-1] == ' ' {
+				b = b[:len(b)-1]
+			}
+			for len(b) > 0 && b[len(b)-1] != ' ' {
+				b = b[:len(b)-1]
+			}
+		case r == 0x15: // ^U
+			b = b[:0]
+		case r < ' ':
+		default:
+			b = append(b, r)
+		}
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func runCommand(line string) {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		f = []string{"help"}
+	}
+	c, ok := commands[f[0]]
+	if !ok {
+		fmt.Printf("unknown command /%s; type /help for a list\n", f[0])
+		return
+	}
+	if err := c.run(f[1:]); err != nil {
+		fmt.Printf("/%s: %v\n", f[0], err)
+	}
+}
+
+// format returns the text shown for a chat message.
+func format(m peer.Message) string {
+	s := node.Format(m)
+	if m.To != "" || m.Target != "" {
+		s = "(direct) " + s
+	}
+	if m.Urgent {
+		s = "(urgent) " + s
+	}
+	return s
+}
+
+// formatPresence returns the text shown when a node joins or leaves the mesh.
+func formatPresence(event string, m peer.Member) string {
+	who := m.Addr
+	if m.Nick != "" {
+		who = m.Nick + " (" + m.Addr + ")"
+	}
+	if event == peer.PresenceLeave {
+		return who + " left"
+	}
+	return who + " joined"
+}
+
+// formatDownload returns the text shown for a file received from a peer.
+func formatDownload(d peer.Download) string {
+	from := d.Addr
+	if d.Nick != "" {
+		from = d.Nick
+	}
+	return fmt.Sprintf("%s shared %s (%d bytes), saved as %s", from, d.Name, d.Size, d.Path)
+}
+
+func cmdHelp(args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range sortedCommands() {
+		c := commands[name]
+		fmt.Fprintf(w, "/%s %s\t%s\n", name, c.args, c.help)
+	}
+	fmt.Fprintf(w, "//text\tsend a message starting with a slash\n")
+	return w.Flush()
+}
+
+func sortedCommands() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func cmdPeers(args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDR\tSTATE\tAGE\tQUEUED\tRTT\tJITTER")
+	for _, p := range node.Peers().Info() {
+		state, age, rtt, jitter := "dialling", "-", "-", "-"
+		if p.Connected {
+			state = "connected"
+			age = time.Since(p.Since).Round(time.Second).String()
+		}
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(time.Microsecond).String()
+			jitter = p.Jitter.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", p.Addr, state, age, p.Queued, rtt, jitter)
+	}
+	return w.Flush()
+}
+
+// addrArg returns the single host:port argument of the named command.
+func addrArg(name string, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("usage: /%s host:port", name)
+	}
+	return args[0], nil
+}
+
+func cmdConnect(args []string) error {
+	addr, err := addrArg("connect", args)
+	if err != nil {
+		return err
+	}
+	go node.Dial(addr)
+	return nil
+}
+
+func cmdDisconnect(args []string) error {
+	addr, err := addrArg("disconnect", args)
+	if err != nil {
+		return err
+	}
+	if !node.Disconnect(addr) {
+		return fmt.Errorf("not connected to %v", addr)
+	}
+	return nil
+}
+
+func cmdBan(args []string) error {
+	if len(args) == 0 {
+		bans := node.Bans()
+		if len(bans) == 0 {
+			fmt.Println("no bans")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDR\tUNTIL\tREASON")
+		for _, b := range bans {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", b.Addr, b.Until.Format(time.DateTime), b.Reason)
+		}
+		return w.Flush()
+	}
+	addr, d, reason, err := banArgs(args)
+	if err != nil {
+		return err
+	}
+	node.Ban(addr, d, reason)
+	return nil
+}
+
+// banArgs parses the arguments of /ban host:port [duration] [reason]. A zero
+// duration stands for -bantime.
+func banArgs(args []string) (addr string, d time.Duration, reason string, err error) {
+	if len(args) == 0 || args[0] == "" {
+		return "", 0, "", fmt.Errorf("usage: /ban [host:port [duration] [reason]]")
+	}
+	rest := args[1:]
+	if len(rest) > 0 {
+		if v, err := time.ParseDuration(rest[0]); err == nil {
+			d, rest = v, rest[1:]
+		}
+	}
+	if d < 0 {
+		return "", 0, "", fmt.Errorf("usage: /ban [host:port [duration] [reason]]")
+	}
+	reason = strings.Join(rest, " ")
+	if reason == "" {
+		reason = "banned by the operator"
+	}
+	return args[0], d, reason, nil
+}
+
+func cmdUnban(args []string) error {
+	addr, err := addrArg("unban", args)
+	if err != nil {
+		return err
+	}
+	if !node.Unban(addr) {
+		return fmt.Errorf("%v is not banned", addr)
+	}
+	return nil
+}
+
+func cmdNick(args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Println(node.Nick())
+	case 1:
+		if err := node.SetNick(args[0]); err != nil {
+			return err
+		}
+		if node.NickTaken(args[0]) {
+			fmt.Printf("another node calls itself %s; your messages will show your ID after it\n", args[0])
+		}
+	default:
+		return fmt.Errorf("usage: /nick [name]")
+	}
+	return nil
+}
+
+func cmdMsg(args []string) error {
+	to, body, err := msgArgs(args)
+	if err != nil {
+		return err
+	}
+	if node.Peers().Get(to) == nil {
+		if id := nodeID(to); id != "" {
+			_, err := node.SendToID(id, body)
+			return err
+		}
+	}
+	_, err = node.SendTo(to, body)
+	if err == peer.ErrNotConnected {
+		return fmt.Errorf("no peer or known node called %s", to)
+	}
+	return err
+}
+
+// msgArgs parses the arguments of /msg host:port|nick|id text.
+func msgArgs(args []string) (to, body string, err error) {
+	if len(args) < 2 {
+		return "", "", fmt.Errorf("usage: /msg host:port|nick|id text")
+	}
+	return args[0], strings.Join(args[1:], " "), nil
+}
+
+// nodeID returns the ID of the node named by s: its ID, or the nickname or
+// address of a node in the roster or the routing table. It returns "" if no
+// node is known by that name.
+func nodeID(s string) string {
+	for _, m := range node.Roster() {
+		if m.ID != "" && m.Addr != self && (m.ID == s || m.Nick == s || m.Addr == s) {
+			return m.ID
+		}
+	}
+	for _, c := range node.Contacts() {
+		if c.ID == s || c.Addr == s {
+			return c.ID
+		}
+	}
+	return ""
+}
+
+func cmdRoutes(args []string) error {
+	l := node.Contacts()
+	if len(l) == 0 {
+		fmt.Println("no routes")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDR")
+	for _, c := range l {
+		fmt.Fprintf(w, "%s\t%s\n", c.ID, c.Addr)
+	}
+	return w.Flush()
+}
+
+func cmdUrgent(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: /urgent text")
+	}
+	node.SendUrgent(strings.Join(args, " "))
+	return nil
+}
+
+func cmdSendFile(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: /send-file path")
+	}
+	f, err := node.SendFile(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sending %s (%d bytes in %d chunks)\n", f.Name, f.Size, f.Chunks)
+	return nil
+}
+
+func cmdRoster(args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NICK\tID\tADDR\tLAST SEEN")
+	for _, m := range node.Roster() {
+		nick, id, seen := m.Nick, m.ID, time.Since(m.LastSeen).Round(time.Second).String()+" ago"
+		if nick == "" {
+			nick = "-"
+		}
+		if id == "" {
+			id = "-"
+		}
+		if m.Addr == self {
+			seen = "(you)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", nick, id, m.Addr, seen)
+	}
+	return w.Flush()
+}
+
+func cmdHistory(args []string) error {
+	h := node.History()
+	if len(h) == 0 {
+		fmt.Println("no messages")
+	}
+	for _, m := range h {
+		fmt.Println(format(m))
+	}
+	return nil
+}
+
+func cmdStats(args []string) error {
+	s := node.Stats()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "peers\t%d\n", node.Peers().Len())
+	fmt.Fprintf(w, "mean rtt\t%s\n", meanRTT())
+	fmt.Fprintf(w, "received\t%d\n", s.Received)
+	fmt.Fprintf(w, "duplicates\t%d\n", s.Duplicates)
+	fmt.Fprintf(w, "delivered\t%d\n", s.Delivered)
+	fmt.Fprintf(w, "held\t%d\n", s.Held)
+	fmt.Fprintf(w, "expired\t%d\n", s.Expired)
+	fmt.Fprintf(w, "sent\t%d\n", s.Sent)
+	fmt.Fprintf(w, "dropped\t%d\n", s.Dropped)
+	fmt.Fprintf(w, "retransmitted\t%d\n", s.Retransmitted)
+	fmt.Fprintf(w, "rate limited\t%d\n", s.Limited)
+	fmt.Fprintf(w, "penalties\t%d\n", s.Penalties)
+	fmt.Fprintf(w, "bans\t%d\n", s.Banned)
+	fmt.Fprintf(w, "routed\t%d\n", s.Routed)
+	fmt.Fprintf(w, "bad messages\t%d\n", s.BadFrames)
+	fmt.Fprintf(w, "bytes in\t%d (%s of %d)\n", s.BytesIn, ratio(s.BytesIn, s.RawIn), s.RawIn)
+	fmt.Fprintf(w, "bytes out\t%d (%s of %d)\n", s.BytesOut, ratio(s.BytesOut, s.RawOut), s.RawOut)
+	return w.Flush()
+}
+
+// meanRTT formats the mean round-trip time to the peers measured so far.
+func meanRTT() string {
+	var sum time.Duration
+	n := 0
+	for _, p := range node.Peers().Info() {
+		if p.RTT > 0 {
+			sum += p.RTT
+			n++
+		}
+	}
+	if n == 0 {
+		return "-"
+	}
+	return (sum / time.Duration(n)).Round(time.Microsecond).String()
+}
+
+// ratio formats the size of compressed data relative to the original.
+func ratio(compressed, raw int64) string {
+	if raw == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(compressed)/float64(raw))
+}
+
+func cmdQuit(args []string) error {
+	slog.Info("quit")
+	node.Close()
+	os.Exit(0)
+	return nil
+}
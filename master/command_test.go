@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/peer"
+)
+
+func TestEditLine(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"hello", "hello"},
+		{"  hello  ", "hello"},
+		{"helo\blo", "hello"},
+		{"hello\x7f\x7f\x7f\x7f\x7f\x7f", ""},
+		{"hello wrld\x17world", "hello world"},
+		{"hello   \x17", ""},
+		{"oops\x15hello", "hello"},
+		{"hel\tlo\x1b", "hello"},
+		{"/msg gopher héllo\b", "/msg gopher héll"},
+	} {
+		if got := editLine(tt.in); got != tt.want {
+			t.Errorf("editLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAddrArg(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string // "" for an error
+	}{
+		{[]string{"10.0.0.1:4000"}, "10.0.0.1:4000"},
+		{nil, ""},
+		{[]string{""}, ""},
+		{[]string{"10.0.0.1:4000", "10.0.0.2:4000"}, ""},
+	} {
+		got, err := addrArg("connect", tt.args)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("addrArg(%q) = %q, %v; want %q", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestBanArgs(t *testing.T) {
+	const addr = "10.0.0.1:4000"
+	for _, tt := range []struct {
+		args   []string
+		d      time.Duration
+		reason string
+		ok     bool
+	}{
+		{[]string{addr}, 0, "banned by the operator", true},
+		{[]string{addr, "2h"}, 2 * time.Hour, "banned by the operator", true},
+		{[]string{addr, "30m", "spamming", "the", "mesh"}, 30 * time.Minute, "spamming the mesh", true},
+		{[]string{addr, "spamming"}, 0, "spamming", true},
+		{[]string{addr, "-1h"}, 0, "", false},
+		{nil, 0, "", false},
+	} {
+		got, d, reason, err := banArgs(tt.args)
+		if (err == nil) != tt.ok {
+			t.Errorf("banArgs(%q): error %v, want ok = %v", tt.args, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got != addr || d != tt.d || reason != tt.reason) {
+			t.Errorf("banArgs(%q) = %q, %v, %q; want %q, %v, %q", tt.args, got, d, reason, addr, tt.d, tt.reason)
+		}
+	}
+}
+
+func TestMsgArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		to, body string
+		ok       bool
+	}{
+		{[]string{"gopher", "hi"}, "gopher", "hi", true},
+		{[]string{"10.0.0.1:4000", "hi", "there"}, "10.0.0.1:4000", "hi there", true},
+		{[]string{"gopher"}, "", "", false},
+		{nil, "", "", false},
+	} {
+		to, body, err := msgArgs(tt.args)
+		if (err == nil) != tt.ok || to != tt.to || body != tt.body {
+			t.Errorf("msgArgs(%q) = %q, %q, %v; want %q, %q, ok = %v", tt.args, to, body, err, tt.to, tt.body, tt.ok)
+		}
+	}
+}
+
+// newTestNode returns a running node listening on the loopback interface.
+func newTestNode(t *testing.T, nick string) *peer.Node {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := peer.New(l, peer.Config{
+		Keepalive: 50 * time.Millisecond,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	t.Cleanup(func() { n.Close() })
+	if err := n.SetNick(nick); err != nil {
+		t.Fatal(err)
+	}
+	go n.Serve()
+	return n
+}
+
+func TestNodeID(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	node = newTestNode(t, "me")
+	self = node.Addr()
+	go node.Dial(alice.Addr())
+	deadline := time.Now().Add(5 * time.Second)
+	for nodeID("alice") == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("alice never joined the roster")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"alice", alice.ID()},
+		{alice.Addr(), alice.ID()},
+		{alice.ID(), alice.ID()},
+		{"me", ""}, // This node isn't a recipient.
+		{"bob", ""},
+	} {
+		if got := nodeID(tt.name); got != tt.want {
+			t.Errorf("nodeID(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// The config file.
+//
+// The config file sets flags in a JSON object keyed by flag name, such as
+//
+//	{
+//		"peer": ["10.0.0.2:4000", "10.0.0.3:4000"],
+//		"nick": "gopher",
+//		"originrate": 10,
+//		"log-level": "debug"
+//	}
+//
+// Flags given on the command line override it. On SIGHUP master reads it
+// again and applies the settings that can change while it runs, listed in
+// reloadable, keeping its connections.
+
+// reloadable lists the flags applied again when the config file is reloaded.
+var reloadable = []string{"peer", "connrate", "connburst", "originrate", "originburst", "penalty", "log-level"}
+
+// config holds the values of the flags set in a config file, by name.
+type config map[string]string
+
+// readConfig reads the config file at path. A missing file is an empty
+// config unless mustExist is set.
+func readConfig(path string, mustExist bool) (config, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !mustExist {
+		return config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c := make(config)
+	for name, v := range raw {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		c[name] = s
+	}
+	return c, nil
+}
+
+// configValue returns the flag value given by v: a string, a number, a
+// boolean, or a list of strings, which is joined with commas.
+func configValue(v json.RawMessage) (string, error) {
+	switch bytes.TrimSpace(v)[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(v, &s)
+		return s, err
+	case '[':
+		var l []string
+		if err := json.Unmarshal(v, &l); err != nil {
+			return "", err
+		}
+		return strings.Join(l, ","), nil
+	case '{':
+		return "", fmt.Errorf("want a string, number, boolean or list, got %s", v)
+	}
+	return string(bytes.TrimSpace(v)), nil
+}
+
+// apply sets the named flags, or all of them if names is nil, to their value
+// in c, or back to their default if c doesn't set them. Flags given on the
+// command line are left alone.
+func (c config) apply(names []string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if names == nil {
+		flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	}
+	for _, name := range names {
+		if given[name] || name == "config" {
+			continue
+		}
+		f := flag.Lookup(name)
+		v, ok := c[name]
+		if !ok {
+			v = f.DefValue
+		}
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// seeds returns the addresses given by -peer.
+func seeds() []string {
+	var l []string
+	for _, a := range strings.Split(*peerAddr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			l = append(l, a)
+		}
+	}
+	return l
+}
+
+// limits returns the rate limits given by the flags.
+func limits() peer.Limits {
+	return peer.Limits{
+		ConnRate:    *connRate,
+		ConnBurst:   *connBurst,
+		OriginRate:  *originRate,
+		OriginBurst: *originBurst,
+		Penalty:     *penalty,
+	}
+}
+
+// reload reads the config file again and applies its reloadable settings:
+// it dials the seed peers it isn't connected to, and changes the rate limits
+// and the log level.
+func reload() {
+	c, err := readConfig(*configFile, flagGiven("config"))
+	if err == nil {
+		err = c.apply(reloadable)
+	}
+	var l slog.Level
+	if err == nil {
+		l, err = util.ParseLogLevel(*logLevel)
+	}
+	if err != nil {
+		slog.Warn("reloading config failed", util.LogErr, err)
+		return
+	}
+	level.Set(l)
+	node.SetLimits(limits())
+	for _, addr := range seeds() {
+		go node.Dial(addr)
+	}
+	slog.Info("reloaded config", "file", *configFile)
+}
+
+// flagGiven reports whether the named flag was given on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	return given
+}
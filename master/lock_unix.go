@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// idLock is the ID file, held open and locked while the node runs.
+var idLock *os.File
+
+// lockID locks the ID file at path, failing if another node holds it.
+func lockID(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return fmt.Errorf("%s is used by another node; give this one its own -idfile", path)
+	}
+	idLock = f
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// errSharingViolation is ERROR_SHARING_VIOLATION, returned when another
+// process has the file open.
+const errSharingViolation syscall.Errno = 32
+
+// idLock is the ID file, held open without sharing while the node runs.
+var idLock *os.File
+
+// lockID opens the ID file at path for this process alone, failing if
+// another node holds it.
+func lockID(path string) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errSharingViolation {
+		return fmt.Errorf("%s is used by another node; give this one its own -idfile", path)
+	}
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	idLock = os.NewFile(uintptr(h), path)
+	return nil
+}
@@ -1,199 +1,275 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/transport"
 	"github.com/campoy/whispering-gophers/util"
 	"golang.org/x/net/websocket"
 )
 
 var (
-	httpAddr = flag.String("http", "localhost:8080", "HTTP server address")
-	peerAddr = flag.String("peer", "", "peer host:port")
-	dedup    = flag.Bool("dedup", true, "de-duplicate messages")
-	self     string
+	httpAddr    = flag.String("http", "localhost:8080", "HTTP server address")
+	peerAddr    = flag.String("peer", "", "comma-separated host:port of the peers to connect to")
+	dedup       = flag.Bool("dedup", true, "de-duplicate messages")
+	mode        = flag.String("mode", "flood", "relay mode: flood, gossip or plumtree")
+	fanout      = flag.Int("fanout", 3, "number of peers each message is relayed to in gossip mode")
+	pushPull    = flag.Duration("pushpull", time.Second, "interval between push-pull rounds in gossip mode (0 to disable)")
+	history     = flag.Int("history", 256, "number of recent messages kept for push-pull rounds and grafts")
+	graft       = flag.Duration("graft", 500*time.Millisecond, "how long to wait for an announced message in plumtree mode")
+	causal      = flag.Bool("causal", false, "show replies only after the messages they answer")
+	hold        = flag.Duration("hold", 2*time.Second, "how long to hold back a message waiting for its predecessors")
+	connRate    = flag.Float64("connrate", 50, "messages per second accepted on each inbound connection (0 for no limit)")
+	connBurst   = flag.Int("connburst", 300, "burst size for -connrate, at least -history")
+	originRate  = flag.Float64("originrate", 5, "new messages per second accepted from each sender (0 for no limit)")
+	originBurst = flag.Int("originburst", 256, "burst size for -originrate, at least -history")
+	penalty     = flag.Duration("penalty", time.Minute, "how long a misbehaving peer stays disconnected")
+	codec       = flag.String("codec", "json", "wire format to ask for on dialled connections: json or binary")
+	compress    = flag.Bool("compress", true, "compress connections to and from peers that support it")
+	maxFrame    = flag.Int("maxframe", 64<<10, "size in bytes of the largest message accepted from a peer")
+	maxBad      = flag.Int("maxbad", 5, "number of invalid messages accepted on a connection before disconnecting")
+	pingEvery   = flag.Duration("ping", 10*time.Second, "interval between pings measuring the round-trip time to each peer (negative to disable)")
+	dhtRefresh  = flag.Duration("dhtrefresh", 15*time.Minute, "interval between the lookups that keep the routing table for direct messages filled (negative to disable)")
+	banScore    = flag.Int("banscore", 100, "misbehaviour score at which a peer is banned (negative to disable)")
+	banTime     = flag.Duration("bantime", time.Hour, "how long a peer stays banned")
+	banFile     = flag.String("banfile", "", "file keeping the ban list across restarts (default: bans.json in ~/.whispering-gophers, named after -http unless it is the default)")
+	useTLS      = flag.Bool("tls", false, "use mutual TLS on all connections; peers must use it too")
+	tlsDir      = flag.String("tlsdir", stateDir(), "directory for the generated certificate and pinned peer fingerprints")
+	certFile    = flag.String("cert", "", "certificate file for -tls (generated in -tlsdir if empty)")
+	keyFile     = flag.String("key", "", "private key file for -cert")
+	caFile      = flag.String("ca", "", "CA certificate for -tls; if empty, peers are trusted on first use")
+	transName   = flag.String("transport", "tcp", "how to reach peers: "+strings.Join(transport.Remote, ", "))
+	acks        = flag.Bool("acks", true, "acknowledge messages on connections to and from peers that support it, and resend unacknowledged ones")
+	nick        = flag.String("nick", "", "nickname attached to your messages")
+	idFile      = flag.String("idfile", "", "file holding the ID that identifies this node across restarts (default: node_id in ~/.whispering-gophers, named after -http unless it is the default)")
+	keepalive   = flag.Duration("keepalive", 30*time.Second, "interval between announcements that this node is still in the mesh (0 to disable)")
+	downloads   = flag.String("downloads", filepath.Join(stateDir(), "downloads"), "directory for the files shared by peers")
+	netKey      = flag.String("netkey", "", "key shared by the nodes of a private network; peers without it are rejected")
+	logLevel    = flag.String("log-level", "info", "lowest level of the logs shown: "+strings.Join(util.LogLevels, ", "))
+	logFormat   = flag.String("log-format", "text", "format of the logs: "+strings.Join(util.LogFormats, " or "))
+	configFile  = flag.String("config", filepath.Join(stateDir(), "config.json"), "JSON file of flag settings, read again on SIGHUP; flags on the command line override it")
+	node        *peer.Node
+	self        string
+	level       slog.LevelVar // changed by reload
 )
 
-type Message struct {
-	ID   string
-	Addr string
-	Body string
-}
-
 func main() {
 	flag.Parse()
 
-	l, err := util.Listen()
+	c, err := readConfig(*configFile, flagGiven("config"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	self = l.Addr().String()
-	log.Println("Listening on", self)
-
-	if *peerAddr != "" {
-		go dial(*peerAddr)
+	if err := c.apply(nil); err != nil {
+		log.Fatalf("%s: %v", *configFile, err)
 	}
-	go readInput()
-
-	go func() {
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			go serve(c)
-		}
-	}()
-
-	http.HandleFunc("/", rootHandler)
-	http.Handle("/log", websocket.Handler(logHandler))
-	err = http.ListenAndServe(*httpAddr, nil)
+	lv, err := util.ParseLogLevel(*logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-var peers = &Peers{m: make(map[string]chan<- Message)}
-
-type Peers struct {
-	m  map[string]chan<- Message
-	mu sync.RWMutex
-}
-
-func (p *Peers) Add(addr string) <-chan Message {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if _, ok := p.m[addr]; ok {
-		return nil
+	level.Set(lv)
+	lg, err := util.NewLogger(io.MultiWriter(os.Stdout, logger.Writer()), &level, *logFormat)
+	if err != nil {
+		log.Fatal(err)
 	}
-	ch := make(chan Message)
-	p.m[addr] = ch
-	return ch
-}
+	slog.SetDefault(lg)
 
-func (p *Peers) Remove(addr string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	delete(p.m, addr)
-}
+	switch peer.Mode(*mode) {
+	case peer.Flood, peer.Gossip, peer.Plumtree:
+	default:
+		fatal("unknown -mode", "mode", *mode)
+	}
+	switch *codec {
+	case peer.CodecJSON, peer.CodecBinary:
+	default:
+		fatal("unknown -codec", "codec", *codec)
+	}
 
-func (p *Peers) List() []chan<- Message {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	l := make([]chan<- Message, 0, len(p.m))
-	for _, ch := range p.m {
-		l = append(l, ch)
+	tr, err := transport.NewRemote(*transName)
+	if err != nil {
+		fatal("bad -transport", util.LogErr, err)
 	}
-	return l
-}
 
-func broadcast(m Message) {
-	for _, ch := range peers.List() {
-		select {
-		case ch <- m:
-		default:
-			// Okay to drop messages sometimes.
-		}
+	if *idFile == "" {
+		*idFile = nodeFile("node_id", *httpAddr)
+	}
+	if *banFile == "" {
+		*banFile = nodeFile("bans.json", *httpAddr)
+	}
+	id, err := peer.LoadID(*idFile)
+	if err != nil {
+		fatal("loading node ID failed", util.LogErr, err)
+	}
+	if err := lockID(*idFile); err != nil {
+		fatal("node ID in use", util.LogErr, err)
 	}
-}
 
-func serve(c net.Conn) {
-	log.Println("<", c.RemoteAddr(), "accepted connection")
-	d := json.NewDecoder(c)
-	for {
-		var m Message
-		err := d.Decode(&m)
-		if err != nil {
-			log.Println("<", c.RemoteAddr(), "error:", err)
-			break
+	cfg := peer.Config{
+		ID:           id,
+		Logger:       lg,
+		Mode:         peer.Mode(*mode),
+		Fanout:       *fanout,
+		PushPull:     *pushPull,
+		History:      *history,
+		NoDedup:      !*dedup,
+		GraftTimeout: *graft,
+		Causal:       *causal,
+		HoldTimeout:  *hold,
+		ConnRate:     *connRate,
+		ConnBurst:    *connBurst,
+		OriginRate:   *originRate,
+		OriginBurst:  *originBurst,
+		Penalty:      *penalty,
+		Codec:        *codec,
+		Compress:     *compress,
+		MaxFrame:     *maxFrame,
+		MaxBadFrames: *maxBad,
+		PingInterval: *pingEvery,
+		DHTRefresh:   *dhtRefresh,
+		BanScore:     *banScore,
+		BanTime:      *banTime,
+		BanFile:      *banFile,
+		Transport:    tr,
+		Acks:         *acks,
+		Deliver: func(m peer.Message) {
+			fmt.Println(format(m))
+		},
+		Keepalive: *keepalive,
+		PresenceChanged: func(event string, m peer.Member) {
+			fmt.Println(formatPresence(event, m))
+		},
+		Downloads: *downloads,
+		Downloaded: func(d peer.Download) {
+			fmt.Println(formatDownload(d))
+		},
+	}
+	if *netKey != "" {
+		cfg.NetworkKey = []byte(*netKey)
+	}
+	if *useTLS {
+		if (*certFile == "") != (*keyFile == "") {
+			fatal("-cert and -key must be given together")
 		}
-		if Seen(m.ID) {
-			continue
+		if *caFile != "" && *certFile == "" {
+			fatal("-ca needs a certificate signed by the CA in -cert")
 		}
-		log.Printf("< %v received: %v", c.RemoteAddr(), m)
-		fmt.Println(m.Body)
-		broadcast(m)
-		go dial(m.Addr)
-	}
-	c.Close()
-	log.Println("<", c.RemoteAddr(), "close")
-}
-
-func readInput() {
-	r := bufio.NewReader(os.Stdin)
-	for {
-		s, err := r.ReadString('\n')
+		cfg.TLS, err = peer.NewTLSConfig(peer.TLSConfig{
+			Dir:      *tlsDir,
+			CertFile: *certFile,
+			KeyFile:  *keyFile,
+			CAFile:   *caFile,
+		})
 		if err != nil {
-			log.Fatal(err)
+			fatal("setting up TLS failed", util.LogErr, err)
 		}
-		m := Message{
-			ID:   util.RandomID(),
-			Addr: self,
-			Body: s[:len(s)-1],
-		}
-		Seen(m.ID)
-		broadcast(m)
 	}
-}
 
-func dial(addr string) {
-	if addr == self {
-		return // Don't try to dial self.
+	l, err := tr.Listen()
+	if err != nil {
+		fatal("listening failed", util.LogErr, err)
 	}
-
-	ch := peers.Add(addr)
-	if ch == nil {
-		return // Peer already connected.
+	node = peer.New(l, cfg)
+	if err := node.SetNick(*nick); err != nil {
+		fatal("bad -nick", util.LogErr, err)
 	}
-	defer peers.Remove(addr)
+	self = node.Addr()
+	slog.Info("listening", "addr", self, util.LogID, node.ID())
 
-	log.Println(">", addr, "dialling")
-	c, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println(">", addr, "dial error:", err)
-		return
+	for _, addr := range seeds() {
+		go node.Dial(addr)
 	}
-	log.Println(">", addr, "connected")
-	defer func() {
-		c.Close()
-		log.Println(">", addr, "closed")
+	go readInput()
+
+	go func() {
+		fatal("serving failed", util.LogErr, node.Serve())
 	}()
 
-	e := json.NewEncoder(c)
-	for m := range ch {
-		err := e.Encode(m)
-		if err != nil {
-			log.Println(">", addr, "error:", err)
-			return
+	go func() {
+		// Tell the mesh we're leaving when interrupted.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cmdQuit(nil)
+	}()
+
+	go func() {
+		// Apply the changes to the config file when asked.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		for range sig {
+			reload()
 		}
+	}()
+
+	http.HandleFunc("/", rootHandler)
+	http.HandleFunc("/roster", rosterHandler)
+	http.HandleFunc("/peers", peersHandler)
+	http.Handle("/log", websocket.Handler(logHandler))
+	err = http.ListenAndServe(*httpAddr, nil)
+	if err != nil {
+		fatal("serving HTTP failed", util.LogErr, err)
+	}
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// stateDir returns the directory for the node's files in the user's home.
+func stateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".whispering-gophers"
 	}
+	return filepath.Join(home, ".whispering-gophers")
 }
 
-var seenIDs = struct {
-	m map[string]bool
-	sync.Mutex
-}{m: make(map[string]bool)}
+// nodeFile returns the path of the state file with the given name for a node
+// serving its UI at httpAddr. Nodes on one machine serve it at different
+// addresses, so each keeps an ID and a ban list of its own: a node with
+// another -http address than the default gets the address added to the
+// name, before its extension.
+func nodeFile(name, httpAddr string) string {
+	if httpAddr != flag.Lookup("http").DefValue {
+		ext := filepath.Ext(name)
+		suffix := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(httpAddr)
+		name = strings.TrimSuffix(name, ext) + "-" + suffix + ext
+	}
+	return filepath.Join(stateDir(), name)
+}
 
-func Seen(id string) bool {
-	if !*dedup || id == "" {
-		return false
+// rosterHandler serves the roster as JSON.
+func rosterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(node.Roster()); err != nil {
+		slog.Info("writing roster failed", util.LogErr, err)
+	}
+}
+
+// peersHandler serves the peer registry, with the round-trip time to each
+// peer, as JSON.
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(node.Peers().Info()); err != nil {
+		slog.Info("writing peers failed", util.LogErr, err)
 	}
-	seenIDs.Lock()
-	ok := seenIDs.m[id]
-	seenIDs.m[id] = true
-	seenIDs.Unlock()
-	return ok
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -211,7 +287,7 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err := rootTemplate.Execute(w, data)
 	if err != nil {
-		log.Println(err)
+		slog.Info("writing page failed", util.LogErr, err)
 	}
 }
 
@@ -268,11 +344,6 @@ type Logger struct {
 
 var logger = &Logger{m: make(map[string]chan<- []byte)}
 
-func init() {
-	log.SetFlags(0)
-	log.SetOutput(io.MultiWriter(os.Stdout, logger.Writer()))
-}
-
 func (l *Logger) Writer() io.Writer {
 	r, w := io.Pipe()
 	go func() {
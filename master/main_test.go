@@ -0,0 +1,22 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeFile(t *testing.T) {
+	for _, tt := range []struct {
+		name, http, want string
+	}{
+		{"node_id", "localhost:8080", "node_id"},
+		{"bans.json", "localhost:8080", "bans.json"},
+		{"node_id", "localhost:8081", "node_id-localhost_8081"},
+		{"bans.json", "localhost:8081", "bans-localhost_8081.json"},
+		{"bans.json", "[::1]:80", "bans-[__1]_80.json"},
+	} {
+		if got := filepath.Base(nodeFile(tt.name, tt.http)); got != tt.want {
+			t.Errorf("nodeFile(%q, %q) = %q, want %q", tt.name, tt.http, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// Per-hop acknowledgements.
+//
+// A dialer with Config.Acks sets Acks in its hello; an acceptor with it too
+// says so in its welcome, and from then on answers the chat messages it
+// reads with ack messages listing their IDs. The dialer keeps the chat
+// messages each such peer hasn't acknowledged in an outbox that outlives the
+// connection, and sends them again every AckTimeout and whenever it
+// reconnects to the peer. The outbox goes when the peer can't be dialled,
+// leaves, or is penalised.
+
+const (
+	defaultAckTimeout = time.Second
+	maxUnacked        = 256 // messages kept per peer; the oldest are dropped first
+)
+
+// outbox holds the chat messages sent to a peer that it hasn't acknowledged,
+// oldest first.
+type outbox struct {
+	mu   sync.Mutex
+	msgs []unacked
+}
+
+type unacked struct {
+	m    Message
+	sent time.Time // zero if the message was dropped before it was sent
+}
+
+// add records that m was sent at the given time, and reports whether an
+// older message had to be dropped to make room.
+func (o *outbox) add(m Message, sent time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := range o.msgs {
+		if o.msgs[i].m.ID == m.ID {
+			o.msgs[i].sent = sent
+			return false
+		}
+	}
+	full := len(o.msgs) >= maxUnacked
+	if full {
+		o.msgs = o.msgs[1:]
+	}
+	o.msgs = append(o.msgs, unacked{m, sent})
+	return full
+}
+
+// ack forgets the messages with the given IDs.
+func (o *outbox) ack(ids []string) {
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	kept := o.msgs[:0]
+	for _, u := range o.msgs {
+		if !acked[u.m.ID] {
+			kept = append(kept, u)
+		}
+	}
+	o.msgs = kept
+}
+
+// due returns the messages last sent no later than the given time, oldest
+// first, and marks them as sent now.
+func (o *outbox) due(by, now time.Time) []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var l []Message
+	for i := range o.msgs {
+		if !o.msgs[i].sent.After(by) {
+			l = append(l, o.msgs[i].m)
+			o.msgs[i].sent = now
+		}
+	}
+	return l
+}
+
+// len returns the number of unacknowledged messages.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.msgs)
+}
+
+// outbox returns the outbox for the peer at addr.
+func (n *Node) outbox(addr string) *outbox {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	o, ok := n.outboxes[addr]
+	if !ok {
+		o = &outbox{}
+		n.outboxes[addr] = o
+	}
+	return o
+}
+
+// unackedBy returns the outbox for the peer at addr if it agreed to
+// acknowledge messages, or nil.
+func (n *Node) unackedBy(addr string) *outbox {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.outboxes[addr]
+}
+
+// dropOutbox forgets the messages the peer at addr hasn't acknowledged.
+func (n *Node) dropOutbox(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.outboxes, addr)
+}
+
+// Unacked returns the number of chat messages sent to the peer at addr that
+// it hasn't acknowledged.
+func (n *Node) Unacked(addr string) int {
+	o := n.unackedBy(addr)
+	if o == nil {
+		return 0
+	}
+	return o.len()
+}
+
+// needsAck reports whether m is a chat message that peers acknowledge.
+func needsAck(m Message) bool {
+	return m.Kind == "" && m.ID != ""
+}
+
+// acker collects the IDs of the chat messages read on an accepted
+// connection, to acknowledge them in batches.
+type acker struct {
+	ids []string
+}
+
+// add adds the ID of m, if it needs an acknowledgement, and reports whether
+// the batch is full.
+func (a *acker) add(m Message) bool {
+	if needsAck(m) {
+		a.ids = append(a.ids, m.ID)
+	}
+	return len(a.ids) >= maxIDs
+}
+
+// take returns the ack for the collected IDs, if any, and starts a new batch.
+func (a *acker) take(self string) (Message, bool) {
+	if len(a.ids) == 0 {
+		return Message{}, false
+	}
+	m := Message{Kind: KindAck, Addr: self, IDs: a.ids}
+	a.ids = nil
+	return m, true
+}
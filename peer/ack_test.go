@@ -0,0 +1,136 @@
+package peer
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// waitFor polls cond until it returns true or timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	const n = 3
+	nodes, delivered := startMesh(t, n, Config{Acks: true, Codec: CodecBinary, Compress: true})
+	for i := 0; i < 10; i++ {
+		nodes[0].Send("hello")
+		waitDelivered(t, n, delivered, 5*time.Second)
+	}
+	waitFor(t, 5*time.Second, "acknowledgements", func() bool {
+		return nodes[0].Unacked(nodes[1].Addr()) == 0 && nodes[0].Unacked(nodes[2].Addr()) == 0
+	})
+	if s := nodes[0].Stats(); s.Retransmitted != 0 {
+		t.Errorf("Stats().Retransmitted = %d, want 0", s.Retransmitted)
+	}
+}
+
+func TestRetransmitAfterReconnect(t *testing.T) {
+	net := transport.NewMemory()
+	nodes, delivered := startMesh(t, 2, Config{Acks: true, AckTimeout: time.Hour, Transport: net})
+	a, b := nodes[0], nodes[1]
+
+	net.Partition([]string{a.Addr()}, []string{b.Addr()})
+	a.Send("lost")
+	if got := a.Unacked(b.Addr()); got != 1 {
+		waitFor(t, 5*time.Second, "the message to be sent", func() bool { return a.Unacked(b.Addr()) == 1 })
+	}
+	net.Heal()
+	a.Disconnect(b.Addr())
+	waitFor(t, 5*time.Second, "the old connection to close", func() bool { return a.Peers().Get(b.Addr()) == nil })
+	go a.Dial(b.Addr())
+
+	waitDelivered(t, 2, delivered, 5*time.Second)
+	waitFor(t, 5*time.Second, "an acknowledgement", func() bool { return a.Unacked(b.Addr()) == 0 })
+	if s := a.Stats(); s.Retransmitted != 1 {
+		t.Errorf("Stats().Retransmitted = %d, want 1", s.Retransmitted)
+	}
+}
+
+func TestRetransmitTimeout(t *testing.T) {
+	clock := transport.NewFakeClock()
+	net := transport.NewMemoryClock(clock)
+	nodes, delivered := startMesh(t, 2, Config{Acks: true, Transport: net, Clock: clock})
+	a, b := nodes[0], nodes[1]
+
+	net.Partition([]string{a.Addr()}, []string{b.Addr()})
+	a.Send("lost")
+	waitFor(t, 5*time.Second, "the message to be sent", func() bool { return a.Unacked(b.Addr()) == 1 })
+	net.Heal()
+	clock.Advance(defaultAckTimeout)
+	waitFor(t, 5*time.Second, "a retransmission", func() bool { return a.Stats().Retransmitted > 0 })
+	clock.Advance(defaultAckTimeout)
+
+	waitDelivered(t, 2, delivered, 5*time.Second)
+	waitFor(t, 5*time.Second, "an acknowledgement", func() bool { return a.Unacked(b.Addr()) == 0 })
+}
+
+func TestDelayedAck(t *testing.T) {
+	delivered := make(chan Message, 2)
+	n := newTestNode(t, Config{Acks: true, BanScore: 3, Deliver: func(m Message) { delivered <- m }})
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e := json.NewEncoder(c)
+	const self = "127.0.0.1:1" // Nobody listens here.
+	e.Encode(Message{Kind: KindHello, Addr: self, Acks: true})
+	// The dialer doesn't read the acks, as if they were delayed, and
+	// sends the message again every AckTimeout.
+	m := Message{ID: util.RandomID(), Addr: self, Body: "hello"}
+	for i := 0; i < 5; i++ {
+		e.Encode(m)
+	}
+	e.Encode(Message{ID: util.RandomID(), Addr: self, Body: "bye"})
+	for _, want := range []string{"hello", "bye"} {
+		select {
+		case got := <-delivered:
+			if got.Body != want {
+				t.Fatalf("delivered %q, want %q", got.Body, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not delivered", want)
+		}
+	}
+	if l := n.Bans(); len(l) != 0 {
+		t.Errorf("Bans = %v, want none for retransmissions", l)
+	}
+}
+
+func TestOutboxes(t *testing.T) {
+	n := newTestNode(t, Config{Acks: true})
+	const addr = "127.0.0.1:1" // Nobody listens here.
+	pc := n.peers.add(addr)
+	fill := func() {
+		for i := 0; i <= queueLen; i++ {
+			n.send(pc, Message{ID: util.RandomID(), Addr: n.Addr(), Body: "hi"})
+		}
+	}
+	fill()
+	if got := n.Unacked(addr); got != 0 {
+		t.Errorf("kept %d messages for a peer that doesn't acknowledge them", got)
+	}
+
+	// Once the peer agrees to acknowledge them, dropped messages are kept.
+	n.outbox(addr)
+	fill()
+	if got := n.Unacked(addr); got != queueLen+1 {
+		t.Errorf("kept %d dropped messages, want %d", got, queueLen+1)
+	}
+	n.penalise(addr, "spam")
+	if got := n.Unacked(addr); got != 0 {
+		t.Errorf("kept %d messages for a penalised peer", got)
+	}
+}
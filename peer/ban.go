@@ -0,0 +1,233 @@
+package peer
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// Misbehaviour scores and bans.
+//
+// Each peer that misbehaves earns points: for bad messages, penalties and
+// messages it repeats. Points halve every scoreHalfLife, so that a peer must
+// keep misbehaving to be banned. A peer whose score reaches Config.BanScore
+// is banned for Config.BanTime: it is disconnected, and its connections and
+// messages are refused. Programs ban and unban peers with Ban and Unban, and
+// keep the list of bans across restarts in Config.BanFile.
+
+const (
+	defaultBanScore = 100
+	defaultBanTime  = time.Hour
+	scoreHalfLife   = 10 * time.Minute
+	maxScores       = 1024 // peers whose score is kept
+	recentIDs       = 256  // message IDs remembered per connection to spot repeats
+)
+
+// Points earned for each kind of misbehaviour.
+const (
+	scoreBadMessage = 10 // malformed or invalid message
+	scorePenalty    = 25 // exceeded a rate limit or was otherwise penalised
+	scoreRepeat     = 1  // sent the same message again on a connection without acks
+)
+
+// Ban is an entry of a node's ban list.
+type Ban struct {
+	Addr   string
+	Until  time.Time
+	Reason string
+}
+
+// score is the misbehaviour score of a peer.
+type score struct {
+	points float64
+	last   time.Time
+}
+
+// decayed returns the points of s at time now.
+func (s score) decayed(now time.Time) float64 {
+	return s.points * math.Exp2(-now.Sub(s.last).Seconds()/scoreHalfLife.Seconds())
+}
+
+// banList holds the misbehaviour scores and the bans of a node.
+type banList struct {
+	mu     sync.Mutex
+	scores map[string]score
+	bans   map[string]Ban
+	file   sync.Mutex // held while writing Config.BanFile
+}
+
+func newBanList() *banList {
+	return &banList{scores: make(map[string]score), bans: make(map[string]Ban)}
+}
+
+// add adds points to the score of addr at time now and returns the new score.
+func (b *banList) add(addr string, points float64, now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.scores[addr]
+	if !ok && len(b.scores) >= maxScores {
+		for a, s := range b.scores {
+			if s.decayed(now) < 1 {
+				delete(b.scores, a)
+			}
+		}
+	}
+	s = score{points: s.decayed(now) + points, last: now}
+	b.scores[addr] = s
+	return s.points
+}
+
+// ban adds ban to the list, replacing any ban of the same address, and
+// forgets the address's score.
+func (b *banList) ban(ban Ban) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[ban.Addr] = ban
+	delete(b.scores, ban.Addr)
+}
+
+// unban removes the ban of addr, and reports whether there was one.
+func (b *banList) unban(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.bans[addr]
+	delete(b.bans, addr)
+	return ok
+}
+
+// list forgets the bans that ended before now and returns the others, sorted
+// by address.
+func (b *banList) list(now time.Time) []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := make([]Ban, 0, len(b.bans))
+	for addr, ban := range b.bans {
+		if ban.Until.Before(now) {
+			delete(b.bans, addr)
+			continue
+		}
+		l = append(l, ban)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Addr < l[j].Addr })
+	return l
+}
+
+// Ban disconnects the peer at addr and refuses its connections and the
+// messages it originates for the duration d, or Config.BanTime if d is zero.
+func (n *Node) Ban(addr string, d time.Duration, reason string) {
+	if d <= 0 {
+		d = n.cfg.BanTime
+	}
+	ban := Ban{Addr: addr, Until: n.cfg.Clock.Now().Add(d), Reason: reason}
+	n.bans.ban(ban)
+	n.limits.penalise(addr, d)
+	atomic.AddInt64(&n.stats.Banned, 1)
+	n.log.Warn("banned", util.LogPeer, addr, "reason", reason, "until", ban.Until)
+	n.Disconnect(addr)
+	n.dropOutbox(addr)
+	n.saveBans()
+}
+
+// Unban lifts the ban of the peer at addr, and any penalty it is serving,
+// and reports whether it was banned.
+func (n *Node) Unban(addr string) bool {
+	ok := n.bans.unban(addr)
+	n.limits.pardon(addr)
+	if ok {
+		n.log.Info("unbanned", util.LogPeer, addr)
+		n.saveBans()
+	}
+	return ok
+}
+
+// Bans returns the bans in force.
+func (n *Node) Bans() []Ban { return n.bans.list(n.cfg.Clock.Now()) }
+
+// misbehaved adds points to the score of the peer at addr, and bans it if
+// the score reaches Config.BanScore.
+func (n *Node) misbehaved(addr string, points float64, reason string) {
+	if addr == "" || n.cfg.BanScore < 0 {
+		return
+	}
+	if n.bans.add(addr, points, n.cfg.Clock.Now()) >= float64(n.cfg.BanScore) {
+		n.Ban(addr, 0, reason)
+	}
+}
+
+// loadBans reads the bans in Config.BanFile, if there is one.
+func (n *Node) loadBans() {
+	if n.cfg.BanFile == "" {
+		return
+	}
+	b, err := os.ReadFile(n.cfg.BanFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var l []Ban
+	if err == nil {
+		err = json.Unmarshal(b, &l)
+	}
+	if err != nil {
+		n.log.Warn("reading bans failed", "file", n.cfg.BanFile, util.LogErr, err)
+		return
+	}
+	now := n.cfg.Clock.Now()
+	for _, ban := range l {
+		if ban.Until.After(now) {
+			n.bans.ban(ban)
+			n.limits.penalise(ban.Addr, ban.Until.Sub(now))
+		}
+	}
+}
+
+// saveBans writes the bans in force to Config.BanFile, if there is one.
+func (n *Node) saveBans() {
+	if n.cfg.BanFile == "" {
+		return
+	}
+	n.bans.file.Lock()
+	defer n.bans.file.Unlock()
+	b, err := json.MarshalIndent(n.Bans(), "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(n.cfg.BanFile), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(n.cfg.BanFile, append(b, '\n'), 0o600)
+	}
+	if err != nil {
+		n.log.Error("saving bans failed", "file", n.cfg.BanFile, util.LogErr, err)
+	}
+}
+
+// recent remembers the last message IDs received on a connection.
+type recent struct {
+	ids  []string
+	m    map[string]bool
+	next int
+}
+
+// repeat records id and reports whether it was received recently.
+func (r *recent) repeat(id string) bool {
+	if r.m[id] {
+		return true
+	}
+	if r.m == nil {
+		r.m = make(map[string]bool)
+	}
+	if len(r.ids) < recentIDs {
+		r.ids = append(r.ids, id)
+	} else {
+		delete(r.m, r.ids[r.next])
+		r.ids[r.next] = id
+		r.next = (r.next + 1) % recentIDs
+	}
+	r.m[id] = true
+	return false
+}
@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+func TestMisbehaviourScore(t *testing.T) {
+	clock := transport.NewFakeClock()
+	n := newTestNode(t, Config{Clock: clock, BanScore: 30, BanTime: time.Hour})
+	const bad = "127.0.0.1:1" // Nobody listens here.
+	n.misbehaved(bad, scoreBadMessage, "sent bad messages")
+	n.misbehaved(bad, scoreBadMessage, "sent bad messages")
+	clock.Advance(2 * scoreHalfLife) // The score decays to 5.
+	n.misbehaved(bad, scoreBadMessage, "sent bad messages")
+	if l := n.Bans(); len(l) != 0 {
+		t.Fatalf("banned %v with a decayed score", l)
+	}
+	n.misbehaved(bad, scorePenalty, "exceeded connection rate limit")
+	l := n.Bans()
+	if len(l) != 1 || l[0].Addr != bad {
+		t.Fatalf("Bans = %v, want a ban of %s", l, bad)
+	}
+	if !n.limits.penalised(bad) {
+		t.Error("banned peer not refused")
+	}
+	n.receive(Message{ID: "a", Addr: bad}, "")
+	if s := n.Stats(); s.Limited != 1 || s.Banned != 1 {
+		t.Errorf("Limited, Banned = %d, %d; want 1, 1", s.Limited, s.Banned)
+	}
+	clock.Advance(time.Hour + time.Second)
+	if l := n.Bans(); len(l) != 0 || n.limits.penalised(bad) {
+		t.Errorf("ban still in force after BanTime: %v", l)
+	}
+}
+
+func TestForgedOrigin(t *testing.T) {
+	n := newTestNode(t, Config{OriginRate: 0.001, OriginBurst: 1})
+	// Nobody listens at these.
+	const origin, relay = "127.0.0.1:1", "127.0.0.1:2"
+	for i := 0; i < 8; i++ {
+		n.receive(Message{ID: fmt.Sprint(i), Addr: origin}, relay)
+	}
+	if l := n.Bans(); len(l) != 0 {
+		t.Errorf("Bans = %v, want none: the relay may be passing on a noisy or forged origin", l)
+	}
+}
+
+func TestBanFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	n := newTestNode(t, Config{BanFile: file})
+	n.Ban("127.0.0.1:1", time.Hour, "spam")
+	n.Ban("127.0.0.1:2", time.Hour, "spam")
+	if !n.Unban("127.0.0.1:2") {
+		t.Error("Unban of a banned peer = false")
+	}
+	if n.Unban("127.0.0.1:3") {
+		t.Error("Unban of a peer that isn't banned = true")
+	}
+
+	// A restarted node keeps its bans.
+	n = newTestNode(t, Config{BanFile: file})
+	l := n.Bans()
+	if len(l) != 1 || l[0].Addr != "127.0.0.1:1" || l[0].Reason != "spam" {
+		t.Fatalf("Bans after a restart = %v, want 127.0.0.1:1 banned for spam", l)
+	}
+	if !n.limits.penalised("127.0.0.1:1") {
+		t.Error("peer banned before a restart not refused")
+	}
+}
@@ -0,0 +1,184 @@
+package peer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// causal holds back chat messages until the messages they causally depend
+// on have been delivered.
+//
+// Every message sent by a node carries a vector clock: for each origin
+// address, the number of messages from that origin the sender had delivered
+// (or sent) when it wrote the message. A message from origin j is ready when
+// it is the next message from j and everything else it depends on has been
+// delivered already.
+//
+// Messages are passed to Config.Deliver in the order they became ready, by
+// one goroutine at a time and without holding mu, so that Deliver may send
+// messages of its own.
+type causal struct {
+	mu      sync.Mutex
+	clock   map[string]uint64
+	pending []held    // oldest first
+	out     []Message // ready to be delivered, oldest first
+	busy    bool      // set while a goroutine delivers out
+}
+
+// maxHeld bounds the messages held back; beyond it, the oldest is delivered
+// as if it had been held for HoldTimeout.
+const maxHeld = 1024
+
+// held is a message waiting for its causal predecessors.
+type held struct {
+	m     Message
+	since time.Time
+}
+
+func newCausal() *causal {
+	return &causal{clock: make(map[string]uint64)}
+}
+
+// stamp counts a message sent by self and returns its vector clock.
+func (c *causal) stamp(self string) map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock[self]++
+	v := make(map[string]uint64, len(c.clock))
+	for k, n := range c.clock {
+		v[k] = n
+	}
+	return v
+}
+
+// ready reports whether every predecessor of m has been delivered, or m is a
+// latecomer whose place in the order has already been given up.
+func (c *causal) ready(m Message) bool {
+	if m.Clock[m.Addr] <= c.clock[m.Addr] {
+		return true // Late; don't hold it back any further.
+	}
+	if m.Clock[m.Addr] != c.clock[m.Addr]+1 {
+		return false
+	}
+	for k, n := range m.Clock {
+		if k != m.Addr && n > c.clock[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// advance merges the vector clock of a delivered message into c.clock.
+func (c *causal) advance(m Message) {
+	for k, n := range m.Clock {
+		if n > c.clock[k] {
+			c.clock[k] = n
+		}
+	}
+}
+
+// release advances c.clock past m and queues m for delivery.
+func (c *causal) release(m Message) {
+	c.advance(m)
+	c.out = append(c.out, m)
+}
+
+// deliver passes m to the user once its causal predecessors have been
+// delivered, holding it back until then if Config.Causal is set.
+func (n *Node) deliver(m Message) {
+	if !n.cfg.Causal || m.Clock == nil {
+		n.show(m)
+		return
+	}
+	c := n.causal
+	c.mu.Lock()
+	if c.ready(m) {
+		c.release(m)
+	} else {
+		atomic.AddInt64(&n.stats.Held, 1)
+		c.pending = append(c.pending, held{m, n.cfg.Clock.Now()})
+		if len(c.pending) > maxHeld {
+			atomic.AddInt64(&n.stats.Expired, 1)
+			c.release(c.pending[0].m)
+			c.pending = c.pending[1:]
+		}
+	}
+	n.flushHeld()
+	c.mu.Unlock()
+	n.showReady()
+}
+
+// flushHeld queues the held messages that have become ready.
+// The caller must hold n.causal.mu.
+func (n *Node) flushHeld() {
+	c := n.causal
+	for progress := true; progress; {
+		progress = false
+		for i, h := range c.pending {
+			if !c.ready(h.m) {
+				continue
+			}
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			c.release(h.m)
+			progress = true
+			break
+		}
+	}
+}
+
+// expireHeld delivers the messages that have been held since before the
+// given time, giving up on their missing predecessors.
+func (n *Node) expireHeld(before time.Time) {
+	c := n.causal
+	c.mu.Lock()
+	kept := c.pending[:0]
+	for _, h := range c.pending {
+		if h.since.After(before) {
+			kept = append(kept, h)
+			continue
+		}
+		atomic.AddInt64(&n.stats.Expired, 1)
+		c.release(h.m)
+	}
+	c.pending = kept
+	n.flushHeld()
+	c.mu.Unlock()
+	n.showReady()
+}
+
+// showReady passes the queued messages to Config.Deliver, unless another
+// goroutine already is.
+func (n *Node) showReady() {
+	c := n.causal
+	c.mu.Lock()
+	if c.busy {
+		c.mu.Unlock()
+		return
+	}
+	c.busy = true
+	for len(c.out) > 0 {
+		m := c.out[0]
+		c.out = c.out[1:]
+		c.mu.Unlock()
+		n.show(m)
+		c.mu.Lock()
+	}
+	c.busy = false
+	c.mu.Unlock()
+}
+
+// expireLoop periodically expires held messages older than HoldTimeout.
+func (n *Node) expireLoop() {
+	for now := range n.cfg.Clock.Tick(n.cfg.HoldTimeout / 2) {
+		n.expireHeld(now.Add(-n.cfg.HoldTimeout))
+	}
+}
+
+// show passes m to Config.Deliver.
+func (n *Node) show(m Message) {
+	if n.cfg.Deliver != nil {
+		atomic.AddInt64(&n.stats.Delivered, 1)
+		n.cfg.Deliver(m)
+	}
+}
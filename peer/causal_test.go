@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+// causalNode returns a Node that orders deliveries causally and records the
+// IDs of the messages it delivers.
+func causalNode(got *[]string) *Node {
+	return &Node{
+		cfg: Config{
+			Causal:      true,
+			HoldTimeout: time.Second,
+			Clock:       transport.RealClock,
+			Deliver:     func(m Message) { *got = append(*got, m.ID) },
+		},
+		causal: newCausal(),
+	}
+}
+
+func TestCausalOrder(t *testing.T) {
+	var got []string
+	n := causalNode(&got)
+
+	// b answers a; c follows b from the same origin.
+	a := Message{ID: "a", Addr: "A", Clock: map[string]uint64{"A": 1}}
+	b := Message{ID: "b", Addr: "B", Clock: map[string]uint64{"A": 1, "B": 1}}
+	c := Message{ID: "c", Addr: "B", Clock: map[string]uint64{"A": 1, "B": 2}}
+
+	n.deliver(c)
+	n.deliver(b)
+	if len(got) != 0 {
+		t.Fatalf("delivered %v before their predecessor", got)
+	}
+	n.deliver(a)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	if s := n.Stats(); s.Held != 2 {
+		t.Errorf("Stats().Held = %d, want 2", s.Held)
+	}
+}
+
+func TestCausalExpire(t *testing.T) {
+	var got []string
+	n := causalNode(&got)
+
+	b := Message{ID: "b", Addr: "B", Clock: map[string]uint64{"A": 1, "B": 1}}
+	n.deliver(b)
+	n.expireHeld(time.Now().Add(-time.Minute))
+	if len(got) != 0 {
+		t.Fatalf("delivered %v before it expired", got)
+	}
+	n.expireHeld(time.Now())
+	if want := []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+
+	// The lost predecessor is delivered late rather than held forever.
+	a := Message{ID: "a", Addr: "A", Clock: map[string]uint64{"A": 1}}
+	n.deliver(a)
+	if want := []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	if s := n.Stats(); s.Expired != 1 {
+		t.Errorf("Stats().Expired = %d, want 1", s.Expired)
+	}
+}
+
+func TestCausalUnstamped(t *testing.T) {
+	var got []string
+	n := causalNode(&got)
+	n.deliver(Message{ID: "x", Addr: "X"})
+	if want := []string{"x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestCausalSendFromDeliver(t *testing.T) {
+	var n *Node
+	replied := make(chan Message, 1)
+	n = newTestNode(t, Config{
+		Causal: true,
+		Deliver: func(m Message) {
+			// Replying takes the causal lock to stamp the reply.
+			replied <- n.Send("re: " + m.Body)
+		},
+	})
+	n.deliver(Message{ID: "a", Addr: "A", Body: "hi", Clock: map[string]uint64{"A": 1}})
+	select {
+	case m := <-replied:
+		if m.Clock["A"] != 1 {
+			t.Errorf("reply Clock = %v, want it to follow the message it answers", m.Clock)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deliver couldn't send a reply")
+	}
+}
+
+func TestCausalMaxHeld(t *testing.T) {
+	var got []string
+	n := causalNode(&got)
+	// Messages from far in the future of their origins, which will never
+	// be ready.
+	for i := 0; i <= maxHeld; i++ {
+		id := fmt.Sprint(i)
+		n.deliver(Message{ID: id, Addr: id, Clock: map[string]uint64{id: 1000}})
+	}
+	if want := []string{"0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want the oldest held message", got)
+	}
+	if l := len(n.causal.pending); l != maxHeld {
+		t.Errorf("holding %d messages, want %d", l, maxHeld)
+	}
+}
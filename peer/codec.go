@@ -0,0 +1,484 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// Wire formats, or codecs, for the messages sent on a connection.
+//
+// Every node accepts both: the acceptor of a connection tells them apart by
+// the first byte of each message. The dialer starts out with JSON, which the
+// code lab programs understand, offers its preferred codec in its hello, and
+// switches once the acceptor's welcome accepts it.
+const (
+	// CodecJSON is a stream of JSON objects, as written by json.Encoder.
+	CodecJSON = "json"
+	// CodecBinary is a stream of frames, each made of the frameMagic
+	// byte, the payload length as a uvarint, and the payload: a sequence
+	// of fields, each a uvarint tag followed by its value. Strings are a
+	// uvarint length followed by the bytes; a Clock entry is a string and
+	// a uvarint. A frame can be skipped without understanding it, so a
+	// corrupt payload doesn't break the stream.
+	CodecBinary = "binary"
+)
+
+// frameMagic starts every binary frame; it can't start a JSON object.
+const frameMagic = 0xB1
+
+// Field tags of the binary codec.
+const (
+	tagID = iota + 1
+	tagAddr
+	tagBody
+	tagKind
+	tagIDs // repeated
+	tagNick
+	tagTo
+	tagClock // repeated
+	tagCodec
+	tagCompress
+	tagNonce
+	tagMAC
+	tagAcks
+	tagFile // a nested payload with the fileTag fields
+	tagPresence
+	tagFrom
+	tagLinks // repeated, each a nested payload with the linkTag fields
+	tagVia   // repeated
+	tagPings
+	tagTarget
+	tagContacts // repeated, each a nested payload with the contactTag fields
+	tagUrgent
+)
+
+// Field tags of a FileChunk in the binary codec.
+const (
+	fileTagName = iota + 1
+	fileTagSize
+	fileTagSum
+	fileTagChunks
+	fileTagIndex
+	fileTagChunkSum
+	fileTagProof // repeated
+)
+
+// errFrameTooLarge is returned by frameDecoder when a frame exceeds the limit.
+var errFrameTooLarge = errors.New("message too large")
+
+// An encoder writes messages to a connection in one of the codecs.
+type encoder interface {
+	Encode(m Message) error
+}
+
+// newEncoder returns an encoder for the given codec.
+func newEncoder(w io.Writer, codec string) encoder {
+	if codec == CodecBinary {
+		return &binaryEncoder{w: w}
+	}
+	return jsonEncoder{json.NewEncoder(w)}
+}
+
+type jsonEncoder struct {
+	e *json.Encoder
+}
+
+func (e jsonEncoder) Encode(m Message) error { return e.e.Encode(m) }
+
+type binaryEncoder struct {
+	w            io.Writer
+	payload, buf []byte
+}
+
+func (e *binaryEncoder) Encode(m Message) error {
+	e.payload = m.appendBinary(e.payload[:0])
+	e.buf = append(e.buf[:0], frameMagic)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(e.payload)))
+	e.buf = append(e.buf, e.payload...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// appendBinary appends the binary payload encoding of m to b.
+func (m *Message) appendBinary(b []byte) []byte {
+	b = appendString(b, tagID, m.ID)
+	b = appendString(b, tagAddr, m.Addr)
+	b = appendString(b, tagBody, m.Body)
+	b = appendString(b, tagKind, m.Kind)
+	for _, id := range m.IDs {
+		b = binary.AppendUvarint(b, tagIDs)
+		b = appendBytes(b, id)
+	}
+	b = appendString(b, tagNick, m.Nick)
+	b = appendString(b, tagTo, m.To)
+	for _, id := range m.Via {
+		b = binary.AppendUvarint(b, tagVia)
+		b = appendBytes(b, id)
+	}
+	// Clock entries are sorted, so that a message always has the same
+	// encoding for sign.
+	addrs := make([]string, 0, len(m.Clock))
+	for addr := range m.Clock {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		b = binary.AppendUvarint(b, tagClock)
+		b = appendBytes(b, addr)
+		b = binary.AppendUvarint(b, m.Clock[addr])
+	}
+	b = appendString(b, tagCodec, m.Codec)
+	b = appendString(b, tagCompress, m.Compress)
+	b = appendString(b, tagNonce, m.Nonce)
+	b = appendString(b, tagMAC, m.MAC)
+	if m.Acks {
+		b = binary.AppendUvarint(b, tagAcks)
+		b = binary.AppendUvarint(b, 1)
+	}
+	if m.Pings {
+		b = binary.AppendUvarint(b, tagPings)
+		b = binary.AppendUvarint(b, 1)
+	}
+	if m.Urgent {
+		b = binary.AppendUvarint(b, tagUrgent)
+		b = binary.AppendUvarint(b, 1)
+	}
+	b = appendString(b, tagPresence, m.Presence)
+	b = appendString(b, tagFrom, m.From)
+	for i := range m.Links {
+		b = binary.AppendUvarint(b, tagLinks)
+		b = appendBytes(b, string(m.Links[i].appendBinary(nil)))
+	}
+	b = appendString(b, tagTarget, m.Target)
+	for i := range m.Contacts {
+		b = binary.AppendUvarint(b, tagContacts)
+		b = appendBytes(b, string(m.Contacts[i].appendBinary(nil)))
+	}
+	if f := m.File; f != nil {
+		var p []byte
+		p = appendString(p, fileTagName, f.Name)
+		p = appendUint(p, fileTagSize, uint64(f.Size))
+		p = appendString(p, fileTagSum, f.Sum)
+		p = appendUint(p, fileTagChunks, uint64(f.Chunks))
+		p = appendUint(p, fileTagIndex, uint64(f.Index))
+		p = appendString(p, fileTagChunkSum, f.ChunkSum)
+		for _, h := range f.Proof {
+			p = binary.AppendUvarint(p, fileTagProof)
+			p = appendBytes(p, h)
+		}
+		b = binary.AppendUvarint(b, tagFile)
+		b = appendBytes(b, string(p))
+	}
+	return b
+}
+
+// appendUint appends a uvarint field, even if it is zero.
+func appendUint(b []byte, tag, v uint64) []byte {
+	b = binary.AppendUvarint(b, tag)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendString appends a string field, unless it is empty.
+func appendString(b []byte, tag uint64, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, tag)
+	return appendBytes(b, s)
+}
+
+func appendBytes(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// errBadPayload is reported for a binary payload that can't be parsed.
+var errBadPayload = &invalidError{"binary message", "truncated"}
+
+// unmarshalBinary decodes a binary payload into m.
+func (m *Message) unmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadPayload
+		}
+		b = b[n:]
+		var s string
+		var ok bool
+		switch tag {
+		case tagID:
+			m.ID, b, ok = readBytes(b)
+		case tagAddr:
+			m.Addr, b, ok = readBytes(b)
+		case tagBody:
+			m.Body, b, ok = readBytes(b)
+		case tagKind:
+			m.Kind, b, ok = readBytes(b)
+		case tagIDs:
+			if s, b, ok = readBytes(b); ok {
+				m.IDs = append(m.IDs, s)
+			}
+		case tagVia:
+			if s, b, ok = readBytes(b); ok {
+				m.Via = append(m.Via, s)
+			}
+		case tagNick:
+			m.Nick, b, ok = readBytes(b)
+		case tagTo:
+			m.To, b, ok = readBytes(b)
+		case tagClock:
+			if s, b, ok = readBytes(b); ok {
+				v, n := binary.Uvarint(b)
+				if ok = n > 0; ok {
+					b = b[n:]
+					if m.Clock == nil {
+						m.Clock = make(map[string]uint64)
+					}
+					m.Clock[s] = v
+				}
+			}
+		case tagCodec:
+			m.Codec, b, ok = readBytes(b)
+		case tagCompress:
+			m.Compress, b, ok = readBytes(b)
+		case tagNonce:
+			m.Nonce, b, ok = readBytes(b)
+		case tagMAC:
+			m.MAC, b, ok = readBytes(b)
+		case tagFile:
+			if s, b, ok = readBytes(b); ok {
+				m.File = new(FileChunk)
+				if err := m.File.unmarshalBinary([]byte(s)); err != nil {
+					return err
+				}
+			}
+		case tagFrom:
+			m.From, b, ok = readBytes(b)
+		case tagLinks:
+			if s, b, ok = readBytes(b); ok {
+				var l Link
+				if err := l.unmarshalBinary([]byte(s)); err != nil {
+					return err
+				}
+				m.Links = append(m.Links, l)
+			}
+		case tagTarget:
+			m.Target, b, ok = readBytes(b)
+		case tagContacts:
+			if s, b, ok = readBytes(b); ok {
+				var c Contact
+				if err := c.unmarshalBinary([]byte(s)); err != nil {
+					return err
+				}
+				m.Contacts = append(m.Contacts, c)
+			}
+		case tagPresence:
+			m.Presence, b, ok = readBytes(b)
+		case tagAcks, tagPings, tagUrgent:
+			v, n := binary.Uvarint(b)
+			if ok = n > 0; ok {
+				b = b[n:]
+				switch tag {
+				case tagAcks:
+					m.Acks = v != 0
+				case tagPings:
+					m.Pings = v != 0
+				default:
+					m.Urgent = v != 0
+				}
+			}
+		default:
+			return &invalidError{"binary message", fmt.Sprintf("unknown field %d", tag)}
+		}
+		if !ok {
+			return errBadPayload
+		}
+	}
+	return nil
+}
+
+// unmarshalBinary decodes the nested payload of a FileChunk into f.
+func (f *FileChunk) unmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadPayload
+		}
+		b = b[n:]
+		var v uint64
+		ok := true
+		switch tag {
+		case fileTagName:
+			f.Name, b, ok = readBytes(b)
+		case fileTagSum:
+			f.Sum, b, ok = readBytes(b)
+		case fileTagChunkSum:
+			f.ChunkSum, b, ok = readBytes(b)
+		case fileTagProof:
+			var s string
+			if s, b, ok = readBytes(b); ok {
+				f.Proof = append(f.Proof, s)
+			}
+		case fileTagSize, fileTagChunks, fileTagIndex:
+			if v, n = binary.Uvarint(b); n <= 0 || v > maxFileSize {
+				return errBadPayload
+			}
+			b = b[n:]
+			switch tag {
+			case fileTagSize:
+				f.Size = int64(v)
+			case fileTagChunks:
+				f.Chunks = int(v)
+			case fileTagIndex:
+				f.Index = int(v)
+			}
+		default:
+			return &invalidError{"binary message", fmt.Sprintf("unknown file field %d", tag)}
+		}
+		if !ok {
+			return errBadPayload
+		}
+	}
+	return nil
+}
+
+func readBytes(b []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return "", nil, false
+	}
+	b = b[n:]
+	return string(b[:l]), b[l:], true
+}
+
+// frameDecoder reads messages in either codec, compressed or not, from a
+// connection. It reads no more than max bytes for a single message, so that
+// a peer can't make a node buffer an arbitrarily large one.
+type frameDecoder struct {
+	r          *bufio.Reader
+	max        int
+	buf        []byte
+	compressed bool
+	raw        *int64 // counts the bytes of decoded messages, if not nil
+}
+
+func newFrameDecoder(r io.Reader, max int) *frameDecoder {
+	return &frameDecoder{r: bufio.NewReader(r), max: max}
+}
+
+// Decode reads the next message into m. Errors for which recoverable
+// returns true leave the decoder at the start of the following message.
+func (d *frameDecoder) Decode(m *Message) error {
+	var b byte
+	for {
+		var err error
+		if b, err = d.r.ReadByte(); err != nil {
+			return err
+		}
+		if b == compressMagic {
+			if d.compressed {
+				return errors.New("compression started twice")
+			}
+			d.compressed = true
+			d.r = bufio.NewReader(flate.NewReader(d.r))
+			continue
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			break
+		}
+	}
+	switch b {
+	case '{':
+		if err := d.readObject(); err != nil {
+			return err
+		}
+		d.count(len(d.buf))
+		dec := json.NewDecoder(bytes.NewReader(d.buf))
+		dec.DisallowUnknownFields()
+		return dec.Decode(m)
+	case frameMagic:
+		l, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return err
+		}
+		if l > uint64(d.max) {
+			return errFrameTooLarge
+		}
+		if cap(d.buf) < int(l) {
+			d.buf = make([]byte, l)
+		}
+		d.buf = d.buf[:l]
+		if _, err := io.ReadFull(d.r, d.buf); err != nil {
+			return err
+		}
+		d.count(1 + uvarintLen(l) + int(l))
+		return m.unmarshalBinary(d.buf)
+	}
+	return fmt.Errorf("unexpected byte %#x at start of message", b)
+}
+
+// uvarintLen returns the number of bytes in the uvarint encoding of x.
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// more reports whether part of another message has already been read from
+// the connection, ignoring the white space between JSON messages.
+func (d *frameDecoder) more() bool {
+	b, _ := d.r.Peek(d.r.Buffered())
+	return len(bytes.TrimLeft(b, " \t\r\n")) > 0
+}
+
+func (d *frameDecoder) count(n int) {
+	if d.raw != nil {
+		atomic.AddInt64(d.raw, int64(n))
+	}
+}
+
+// readObject reads the rest of a JSON object whose opening brace has been
+// read into d.buf, finding its end by matching brackets outside strings.
+// The contents are checked by the JSON decoder later.
+func (d *frameDecoder) readObject() error {
+	d.buf = append(d.buf[:0], '{')
+	depth, inString, escaped := 1, false, false
+	for depth > 0 {
+		if len(d.buf) >= d.max {
+			return errFrameTooLarge
+		}
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		d.buf = append(d.buf, b)
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
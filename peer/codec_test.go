@@ -0,0 +1,212 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessage = Message{
+	ID:     "0123456789abcdef",
+	Addr:   "10.0.0.1:4000",
+	Body:   "Ahoy! Is anybody out there?",
+	Kind:   "",
+	IDs:    []string{"fedcba9876543210", "0011223344556677"},
+	Nick:   "gopher",
+	From:   "00112233aabbccdd",
+	Via:    []string{"0123456789abcdef", "fedcba9876543210"},
+	Urgent: true,
+	Clock:  map[string]uint64{"10.0.0.1:4000": 3, "10.0.0.2:4000": 7},
+}
+
+var testChunk = Message{
+	ID:   "0123456789abcdef",
+	Addr: "10.0.0.1:4000",
+	Body: "aGVsbG8K",
+	File: &FileChunk{
+		Name:     "hello.txt",
+		Size:     6,
+		Sum:      strings.Repeat("ab", 32),
+		Chunks:   1,
+		ChunkSum: strings.Repeat("cd", 32),
+		Proof:    []string{strings.Repeat("ef", 32)},
+	},
+}
+
+var testNeighbours = Message{
+	Kind: KindNeighbours,
+	Addr: "10.0.0.1:4000",
+	Links: []Link{
+		{Addr: "10.0.0.2:4000", Dir: "out", Age: 90 * time.Second},
+		{Addr: "10.0.0.3:4000", Dir: "in"},
+	},
+}
+
+var testNodes = Message{
+	Kind:   KindNodes,
+	Addr:   "10.0.0.1:4000",
+	From:   "00112233aabbccdd",
+	Target: "0123456789abcdef",
+	Contacts: []Contact{
+		{ID: "0123456789abcdee", Addr: "10.0.0.2:4000"},
+		{ID: "fedcba9876543210", Addr: "10.0.0.3:4000"},
+	},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, want := range []Message{testMessage, testChunk, testNeighbours, testNodes} {
+		for _, codec := range []string{CodecJSON, CodecBinary} {
+			var buf bytes.Buffer
+			e := newEncoder(&buf, codec)
+			if err := e.Encode(want); err != nil {
+				t.Fatalf("%s: Encode: %v", codec, err)
+			}
+			var m Message
+			if err := newFrameDecoder(&buf, 1<<10).Decode(&m); err != nil {
+				t.Fatalf("%s: Decode: %v", codec, err)
+			}
+			if !reflect.DeepEqual(m, want) {
+				t.Errorf("%s: decoded %+v, want %+v", codec, m, want)
+			}
+		}
+	}
+}
+
+func TestMixedStream(t *testing.T) {
+	var buf bytes.Buffer
+	newEncoder(&buf, CodecJSON).Encode(Message{Body: "one"})
+	newEncoder(&buf, CodecJSON).Encode(Message{Body: `two {"}`})
+	// A binary frame with a corrupt payload...
+	buf.Write([]byte{frameMagic, 2, 0xff, 0xff})
+	// ...and a JSON object that doesn't fit the schema can be skipped.
+	buf.WriteString(`{"Body": 3}`)
+	newEncoder(&buf, CodecBinary).Encode(Message{Body: "four"})
+
+	d := newFrameDecoder(&buf, 1<<10)
+	var got []string
+	for {
+		var m Message
+		err := d.Decode(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !recoverable(err) {
+				t.Fatalf("unrecoverable error: %v", err)
+			}
+			got = append(got, "error")
+			continue
+		}
+		got = append(got, m.Body)
+	}
+	want := []string{"one", `two {"}`, "error", "error", "four"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %q, want %q", got, want)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	b := []byte{frameMagic}
+	b = binary.AppendUvarint(b, 1<<20)
+	var m Message
+	if err := newFrameDecoder(bytes.NewReader(b), 1<<10).Decode(&m); err != errFrameTooLarge {
+		t.Errorf("Decode returned %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestBinaryMesh(t *testing.T) {
+	const n = 4
+	nodes, delivered := startMesh(t, n, Config{Codec: CodecBinary})
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, codec := range []string{CodecJSON, CodecBinary} {
+		b.Run(codec, func(b *testing.B) {
+			var buf bytes.Buffer
+			e := newEncoder(&buf, codec)
+			e.Encode(testMessage)
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				e.Encode(testMessage)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, codec := range []string{CodecJSON, CodecBinary} {
+		b.Run(codec, func(b *testing.B) {
+			var buf bytes.Buffer
+			newEncoder(&buf, codec).Encode(testMessage)
+			frame := buf.Bytes()
+			r := bytes.NewReader(frame)
+			d := newFrameDecoder(r, 1<<10)
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(frame)
+				d.r.Reset(r)
+				var m Message
+				if err := d.Decode(&m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	var buf bytes.Buffer
+	var wire, raw int64
+	s := newOutStream(&buf, &wire, &raw)
+	s.Encode(Message{Body: "before"})
+	s.setCodec(CodecBinary)
+	if err := s.compress(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Encode(testMessage)
+	}
+	s.Flush()
+	if wire >= raw {
+		t.Errorf("wrote %d bytes for %d bytes of messages, want fewer", wire, raw)
+	}
+
+	d := newFrameDecoder(&buf, 1<<10)
+	var m Message
+	if err := d.Decode(&m); err != nil || m.Body != "before" {
+		t.Fatalf("Decode = %+v, %v; want the uncompressed message", m, err)
+	}
+	for i := 0; i < 10; i++ {
+		m = Message{}
+		if err := d.Decode(&m); err != nil {
+			t.Fatalf("Decode compressed message %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(m, testMessage) {
+			t.Fatalf("decoded %+v, want %+v", m, testMessage)
+		}
+	}
+}
+
+func TestCompressedMesh(t *testing.T) {
+	const n = 3
+	nodes, delivered := startMesh(t, n, Config{Compress: true})
+	for i := 0; i < 20; i++ {
+		nodes[0].Send("the same old message, over and over again")
+		waitDelivered(t, n, delivered, 5*time.Second)
+	}
+	s := nodes[1].Stats()
+	if s.BytesIn == 0 || s.BytesIn >= s.RawIn {
+		t.Errorf("read %d bytes for %d bytes of messages, want fewer", s.BytesIn, s.RawIn)
+	}
+}
@@ -0,0 +1,409 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// DHT routing.
+//
+// Every node keeps a Kademlia routing table of the nodes it knows, ordered
+// by the XOR distance between their IDs and its own: bucket i holds up to
+// dhtK nodes whose ID has the same first i bits as the node's and differs in
+// the next one. Nodes learn of each other from hellos and welcomes, from the
+// chat messages they receive, and from the answers to find-node messages, in
+// which the dialer of a connection asks the acceptor for the nodes it knows
+// closest to Target.
+//
+// A lookup of an ID asks the dhtAlpha closest nodes known, dialling them if
+// need be, then the closer nodes they answer with, until the dhtK closest
+// nodes known have all been asked. A node looks up its own ID once it learns
+// of a first node, and a random ID in each bucket it hasn't looked up in for
+// Config.DHTRefresh, so that its table covers the whole ID space.
+//
+// SendToID sends a direct message to a node by ID. Each node passes it to the
+// node it knows closest to the recipient, provided that one is closer than
+// itself, so that it arrives in O(log N) hops instead of being flooded. A
+// node with Config.NoDiscover only asks and routes through its peers.
+
+const (
+	dhtK              = 8  // nodes per bucket and per answer
+	dhtAlpha          = 3  // nodes asked at once by a lookup
+	dhtBuckets        = 64 // bits in a node ID
+	defaultDHTRefresh = 15 * time.Minute
+	lookupTimeout     = 30 * time.Second // time after which a lookup ignores answers
+)
+
+// ErrNoRoute is returned by SendToID when the node knows no node closer to
+// the recipient than itself.
+var ErrNoRoute = errors.New("no route to node")
+
+// Contact is an entry of a node's routing table.
+type Contact struct {
+	ID   string
+	Addr string
+}
+
+// Field tags of a Contact in the binary codec.
+const (
+	contactTagID = iota + 1
+	contactTagAddr
+)
+
+// idKey returns the position of the node ID id in the key space.
+func idKey(id string) uint64 {
+	k, _ := strconv.ParseUint(id, 16, 64)
+	return k
+}
+
+// lookup is a lookup in progress.
+type lookup struct {
+	asked   map[string]bool // IDs of the nodes asked
+	started time.Time
+}
+
+// table is a Kademlia routing table.
+type table struct {
+	mu        sync.Mutex
+	self      uint64
+	buckets   [dhtBuckets][]Contact // least recently seen first
+	refreshed [dhtBuckets]time.Time // when each bucket was last looked up
+	lookups   map[string]*lookup    // by target ID
+}
+
+func newTable(id string) *table {
+	return &table{self: idKey(id), lookups: make(map[string]*lookup)}
+}
+
+// bucket returns the index of the bucket for key k, or -1 if k is the
+// node's own.
+func (t *table) bucket(k uint64) int {
+	if k == t.self {
+		return -1
+	}
+	return bits.LeadingZeros64(k ^ t.self)
+}
+
+// add records that c was seen, moving it to the end of its bucket, and
+// reports whether it is new to the table. A full bucket keeps the nodes it
+// has; they are removed once they can't be reached.
+func (t *table) add(c Contact) bool {
+	i := t.bucket(idKey(c.ID))
+	if i < 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, x := range b {
+		if x.ID == c.ID {
+			copy(b[j:], b[j+1:])
+			b[len(b)-1] = c
+			return false
+		}
+	}
+	if len(b) >= dhtK {
+		return false
+	}
+	t.buckets[i] = append(b, c)
+	return true
+}
+
+// remove forgets the nodes at addr.
+func (t *table) remove(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, b := range t.buckets {
+		l := b[:0]
+		for _, c := range b {
+			if c.Addr != addr {
+				l = append(l, c)
+			}
+		}
+		t.buckets[i] = l
+	}
+}
+
+// closest returns up to k of the nodes for which ok returns true, or of all
+// nodes if ok is nil, sorted by distance to key.
+func (t *table) closest(key uint64, k int, ok func(Contact) bool) []Contact {
+	var l []Contact
+	t.mu.Lock()
+	for _, b := range t.buckets {
+		for _, c := range b {
+			if ok == nil || ok(c) {
+				l = append(l, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(l, func(i, j int) bool { return idKey(l[i].ID)^key < idKey(l[j].ID)^key })
+	if len(l) > k {
+		l = l[:k]
+	}
+	return l
+}
+
+// next returns the node for which ok returns true that is closest to key,
+// if it is closer than the node itself.
+func (t *table) next(key uint64, ok func(Contact) bool) (Contact, bool) {
+	l := t.closest(key, 1, ok)
+	if len(l) == 0 || idKey(l[0].ID)^key >= t.self^key {
+		return Contact{}, false
+	}
+	return l[0], true
+}
+
+// begin starts a lookup of target at time now, unless one is in progress,
+// and forgets the lookups that timed out.
+func (t *table) begin(target string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, l := range t.lookups {
+		if now.Sub(l.started) > lookupTimeout {
+			delete(t.lookups, id)
+		}
+	}
+	if t.lookups[target] == nil {
+		t.lookups[target] = &lookup{asked: make(map[string]bool), started: now}
+	}
+	if i := t.bucket(idKey(target)); i >= 0 {
+		t.refreshed[i] = now
+	}
+}
+
+// toAsk returns up to dhtAlpha of the dhtK nodes for which ok returns true
+// closest to target that its lookup hasn't asked yet, and marks them asked.
+// It returns nil if target isn't being looked up.
+func (t *table) toAsk(target string, now time.Time, ok func(Contact) bool) []Contact {
+	l := t.closest(idKey(target), dhtK, ok)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lk := t.lookups[target]
+	if lk == nil || now.Sub(lk.started) > lookupTimeout {
+		return nil
+	}
+	var ask []Contact
+	for _, c := range l {
+		if len(ask) < dhtAlpha && !lk.asked[c.ID] {
+			lk.asked[c.ID] = true
+			ask = append(ask, c)
+		}
+	}
+	return ask
+}
+
+// stale returns a random ID in each bucket not looked up since cutoff, up to
+// the deepest bucket that holds a node.
+func (t *table) stale(cutoff time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deepest := -1
+	for i, b := range t.buckets {
+		if len(b) > 0 {
+			deepest = i
+		}
+	}
+	var l []string
+	for i := 0; i <= deepest; i++ {
+		if t.refreshed[i].Before(cutoff) {
+			// Keep the first i bits, flip the next one and pick
+			// the rest at random.
+			bit := uint64(1) << (dhtBuckets - 1 - i)
+			k := t.self&^(bit<<1-1) | ^t.self&bit | rand.Uint64()&(bit-1)
+			l = append(l, fmt.Sprintf("%016x", k))
+		}
+	}
+	return l
+}
+
+// Contacts returns the nodes in the node's routing table, closest to it
+// first.
+func (n *Node) Contacts() []Contact {
+	return n.dht.closest(n.dht.self, dhtBuckets*dhtK, nil)
+}
+
+// learn adds c to the routing table, and looks up the node's own ID when c
+// is the first node it learns of.
+func (n *Node) learn(c Contact) {
+	if c.ID == "" || c.Addr == "" || c.Addr == n.self {
+		return
+	}
+	if n.dht.add(c) && atomic.CompareAndSwapInt32(&n.bootstrapped, 0, 1) {
+		n.findNode(n.id)
+	}
+}
+
+// reachable reports whether lookups and routed messages may go to c: any
+// node, or only the node's peers with Config.NoDiscover.
+func (n *Node) reachable(c Contact) bool {
+	return !n.cfg.NoDiscover || n.peers.Get(c.Addr) != nil
+}
+
+// findNode starts a lookup of the nodes closest to target.
+func (n *Node) findNode(target string) {
+	if n.cfg.DHTRefresh < 0 {
+		return
+	}
+	n.log.Debug("looking up", "target", target)
+	n.dht.begin(target, n.cfg.Clock.Now())
+	n.query(target)
+}
+
+// query sends find-node messages to the next nodes the lookup of target
+// should ask.
+func (n *Node) query(target string) {
+	for _, c := range n.dht.toAsk(target, n.cfg.Clock.Now(), n.reachable) {
+		if pc := n.open(c.Addr); pc != nil {
+			n.send(pc, Message{Kind: KindFindNode, Addr: n.self, Target: target})
+		}
+	}
+}
+
+// nodes returns the answer to the find-node message m.
+func (n *Node) nodes(m Message) Message {
+	return Message{
+		Kind:     KindNodes,
+		Addr:     n.self,
+		From:     n.id,
+		Target:   m.Target,
+		Contacts: n.dht.closest(idKey(m.Target), dhtK, nil),
+	}
+}
+
+// found handles the answer to a find-node message: it learns the nodes it
+// lists and carries on with the lookup.
+func (n *Node) found(m Message) {
+	n.learn(Contact{ID: m.From, Addr: m.Addr})
+	for _, c := range m.Contacts {
+		n.learn(c)
+	}
+	n.query(m.Target)
+}
+
+// refresh looks up a random ID in each stale bucket every Config.DHTRefresh.
+func (n *Node) refresh() {
+	for range n.cfg.Clock.Tick(n.cfg.DHTRefresh) {
+		if n.isClosed() {
+			return
+		}
+		for _, target := range n.dht.stale(n.cfg.Clock.Now().Add(-n.cfg.DHTRefresh)) {
+			n.findNode(target)
+		}
+	}
+}
+
+// SendToID sends a direct message with the given body to the node with the
+// given ID, routing it through the nodes closest to that ID, and returns it.
+// When the node knows no route, it looks the ID up, so that a later attempt
+// may find one.
+func (n *Node) SendToID(id, body string) (Message, error) {
+	m := Message{
+		ID:     util.RandomID(),
+		Addr:   n.self,
+		Body:   body,
+		Nick:   n.Nick(),
+		From:   n.id,
+		Target: id,
+	}
+	n.Seen(m.ID)
+	if !n.forward(m) {
+		n.findNode(id)
+		return m, ErrNoRoute
+	}
+	return m, nil
+}
+
+// forward passes a routed message on to the node closest to its Target, and
+// reports whether there was one closer than this node.
+func (n *Node) forward(m Message) bool {
+	c, ok := n.dht.next(idKey(m.Target), n.reachable)
+	if !ok {
+		return false
+	}
+	pc := n.open(c.Addr)
+	if pc == nil {
+		return false
+	}
+	n.send(pc, m)
+	return true
+}
+
+// receiveRouted delivers a direct message routed by ID if it is for this
+// node, and passes it on towards its recipient otherwise.
+func (n *Node) receiveRouted(m Message, from string) {
+	if n.seen.Has(m.ID) {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		return
+	}
+	if !n.withinLimits(m, from) {
+		return
+	}
+	if n.Seen(m.ID) {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		return
+	}
+	if m.Target == n.id {
+		n.learnName(m)
+		n.log.Debug("received direct message", util.LogOrigin, m.Addr, util.LogID, m.ID, "via", m.Via, "text", n.Format(m))
+		n.see(m)
+		n.show(m)
+		return
+	}
+	if len(m.Via) >= maxVia || !n.forward(n.hop(m)) {
+		n.log.Debug("dropped direct message: no route", util.LogOrigin, m.Addr, util.LogID, m.ID, "target", m.Target)
+		return
+	}
+	atomic.AddInt64(&n.stats.Routed, 1)
+}
+
+// validate checks a contact received from a peer.
+func (c *Contact) validate() error {
+	switch {
+	case !validHex(c.ID, idLen):
+		return &invalidError{"Contacts.ID", strconv.Quote(c.ID)}
+	case !validAddr(c.Addr):
+		return &invalidError{"Contacts.Addr", strconv.Quote(c.Addr)}
+	}
+	return nil
+}
+
+// appendBinary appends the nested binary payload of c to b.
+func (c *Contact) appendBinary(b []byte) []byte {
+	b = appendString(b, contactTagID, c.ID)
+	return appendString(b, contactTagAddr, c.Addr)
+}
+
+// unmarshalBinary decodes the nested payload of a Contact into c.
+func (c *Contact) unmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadPayload
+		}
+		b = b[n:]
+		var ok bool
+		switch tag {
+		case contactTagID:
+			c.ID, b, ok = readBytes(b)
+		case contactTagAddr:
+			c.Addr, b, ok = readBytes(b)
+		default:
+			return &invalidError{"binary message", fmt.Sprintf("unknown contact field %d", tag)}
+		}
+		if !ok {
+			return errBadPayload
+		}
+	}
+	return nil
+}
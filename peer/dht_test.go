@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	tb := newTable("8000000000000000")
+	for i := 0; i < dhtK+2; i++ {
+		// All but the first go in bucket 0, which only keeps dhtK.
+		tb.add(Contact{ID: fmt.Sprintf("%016x", i), Addr: fmt.Sprintf("10.0.0.%d:4000", i)})
+	}
+	tb.add(Contact{ID: "c000000000000000", Addr: "10.0.1.1:4000"})
+	tb.add(Contact{ID: "8000000000000001", Addr: "10.0.1.2:4000"})
+	if !tb.add(Contact{ID: "8000000000000002", Addr: "10.0.1.3:4000"}) {
+		t.Error("add of a new contact reported it known")
+	}
+	if tb.add(Contact{ID: "8000000000000000", Addr: "10.0.1.4:4000"}) {
+		t.Error("add of the node itself reported it new")
+	}
+	if l := tb.buckets[0]; len(l) != dhtK || l[0].ID != "0000000000000000" {
+		t.Errorf("bucket 0 = %v, want the first %d contacts", l, dhtK)
+	}
+	var got []string
+	for _, c := range tb.closest(idKey("8000000000000003"), 3, nil) {
+		got = append(got, c.ID)
+	}
+	if want := []string{"8000000000000002", "8000000000000001", "c000000000000000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("closest = %v, want %v", got, want)
+	}
+	if c, ok := tb.next(idKey("c000000000000001"), nil); !ok || c.ID != "c000000000000000" {
+		t.Errorf("next = %v, %v; want c000000000000000", c, ok)
+	}
+	if c, ok := tb.next(idKey("8000000000000000"), nil); ok {
+		t.Errorf("next of the node's own ID = %v, want none", c)
+	}
+	tb.remove("10.0.1.1:4000")
+	if l := tb.buckets[1]; len(l) != 0 {
+		t.Errorf("bucket 1 = %v after remove, want empty", l)
+	}
+	// 8000000000000001 is in the last bucket, so all are stale, none of
+	// them looked up yet.
+	if l := tb.stale(time.Now()); len(l) != dhtBuckets {
+		t.Errorf("stale returned %d IDs, want %d", len(l), dhtBuckets)
+	} else if b := tb.bucket(idKey(l[5])); b != 5 {
+		t.Errorf("stale ID %s is in bucket %d, want 5", l[5], b)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	// A line 0 - 1 - 2 - 3 in which each node is closer to 3 than the
+	// one before it.
+	ids := []string{"f000000000000000", "7000000000000000", "3000000000000000", "1000000000000000"}
+	got := make(chan Message, 1)
+	var nodes []*Node
+	for i, id := range ids {
+		cfg := Config{NoDiscover: true, ID: id}
+		if i == 3 {
+			cfg.Deliver = func(m Message) { got <- m }
+		} else {
+			cfg.Deliver = func(m Message) { t.Errorf("message delivered to %s", id) }
+		}
+		nodes = append(nodes, newTestNode(t, cfg))
+	}
+	for i := 0; i < 3; i++ {
+		go nodes[i].Dial(nodes[i+1].Addr())
+	}
+	waitFor(t, 5*time.Second, "the line to connect", func() bool {
+		for i, n := range nodes {
+			want := 2
+			if i == 0 || i == 3 {
+				want = 1
+			}
+			if n.Peers().Len() != want || len(n.dht.closest(0, dhtK, n.reachable)) != want {
+				return false
+			}
+		}
+		return true
+	})
+	if _, err := nodes[0].SendToID(ids[3], "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if want := ids[1:3]; !reflect.DeepEqual(m.Via, want) {
+			t.Errorf("Via = %v, want %v", m.Via, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	if s := nodes[1].Stats(); s.Routed != 1 {
+		t.Errorf("Stats().Routed = %d, want 1", s.Routed)
+	}
+	if _, err := nodes[3].SendToID(ids[3], "hello"); err != ErrNoRoute {
+		t.Errorf("SendToID to self: %v, want ErrNoRoute", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	const n = 12
+	got := make(chan int, n)
+	var nodes []*Node
+	for i := 0; i < n; i++ {
+		i := i
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		nodes = append(nodes, New(l, Config{Deliver: func(Message) { got <- i }}))
+		go nodes[i].Serve()
+		if i > 0 {
+			// Everyone joins through node 0, and finds the others
+			// by looking up its own ID.
+			go nodes[i].Dial(nodes[0].Addr())
+		}
+	}
+	for i := 2; i < n; i++ {
+		waitFor(t, 5*time.Second, fmt.Sprintf("a direct message to node %d", i), func() bool {
+			if _, err := nodes[1].SendToID(nodes[i].ID(), "hello"); err != nil {
+				return false
+			}
+			select {
+			case j := <-got:
+				if j != i {
+					t.Fatalf("message for node %d delivered to node %d", i, j)
+				}
+				return true
+			case <-time.After(time.Second):
+				return false
+			}
+		})
+	}
+}
@@ -0,0 +1,566 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// File sharing.
+//
+// SendFile splits a file into chunks of chunkSize bytes and sends each one
+// through the mesh as a chat message whose File describes the chunk and whose
+// Body holds its data, base64 encoded. The ID of a chunk message is derived
+// from the file's hash and the chunk's index, so every node knows the IDs of
+// the chunks it is missing. A node that got some chunks of a file and then
+// stops hearing about it asks a peer for the rest with a pull message, every
+// fileResume, until it has them all or fileRetries requests in a row bring
+// nothing new. Complete files are checked against their hash and written to
+// Config.Downloads.
+//
+// The hash of a file covers its name, its size and the root of a Merkle tree
+// over the hashes of its chunks, and each chunk carries the hashes linking it
+// to that root. A node checks every chunk against the file it claims to be
+// part of before keeping or relaying it, so a forged chunk can't take the
+// place of the genuine one.
+
+const (
+	chunkSize   = 16 << 10
+	maxFileSize = 1 << 20
+	maxFiles    = 16 // files kept in memory to answer pulls; the oldest are dropped first
+	fileResume  = 2 * time.Second
+	fileRetries = 5
+	hashLen     = 64 // length of a hex SHA-256
+	maxProof    = 6  // hashes in the proof of a chunk: the depth of the tree of the largest file
+)
+
+// FileChunk describes the chunk of a shared file carried by a chat message.
+type FileChunk struct {
+	Name     string   // base name of the file
+	Size     int64    // size of the file in bytes
+	Sum      string   // hex hash of the file, which identifies it; see fileSum
+	Chunks   int      // number of chunks in the file
+	Index    int      // position of this chunk, from 0
+	ChunkSum string   // hex SHA-256 of this chunk
+	Proof    []string // hex hashes linking ChunkSum to Sum; see merkleTree
+}
+
+// Download describes a file written to Config.Downloads.
+type Download struct {
+	Name string // name of the file as sent
+	Path string // where it was written
+	Size int64
+	Addr string // address of the node that sent it
+	Nick string // nickname of its sender
+}
+
+// ErrFileTooLarge is returned by SendFile for files over the size limit.
+var ErrFileTooLarge = fmt.Errorf("file larger than %d bytes", maxFileSize)
+
+// SendFile shares the file at path with the mesh, and returns the
+// description of its first chunk.
+func (n *Node) SendFile(path string) (FileChunk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return FileChunk{}, err
+	}
+	if len(data) == 0 {
+		return FileChunk{}, errors.New("file is empty")
+	}
+	if len(data) > maxFileSize {
+		return FileChunk{}, ErrFileTooLarge
+	}
+	if !validFileName(filepath.Base(path)) {
+		return FileChunk{}, fmt.Errorf("can't share a file called %q", filepath.Base(path))
+	}
+	name := filepath.Base(path)
+	sum, chunks, proofs := hashFile(name, data)
+	f := FileChunk{
+		Name:   name,
+		Size:   int64(len(data)),
+		Sum:    sum,
+		Chunks: len(chunks),
+	}
+	t := n.files.add(f, n.self, n.Nick())
+	var msgs []Message
+	for i, b := range chunks {
+		c := f
+		c.Index = i
+		c.ChunkSum = hex.EncodeToString(sha256Sum(b))
+		c.Proof = proofs[i]
+		m := Message{
+			ID:   chunkID(f.Sum, i),
+			Addr: n.self,
+			Body: base64.StdEncoding.EncodeToString(b),
+			Nick: t.nick,
+			From: n.id,
+			File: &c,
+		}
+		n.Seen(m.ID)
+		n.files.put(t, m)
+		msgs = append(msgs, m)
+	}
+	for _, m := range msgs {
+		n.relay(m, "")
+	}
+	return msgs[0].File.header(), nil
+}
+
+// header returns f without the fields that describe a single chunk.
+func (f FileChunk) header() FileChunk {
+	f.Index, f.ChunkSum, f.Proof = 0, "", nil
+	return f
+}
+
+// hashFile splits the contents of the file called name into chunks, and
+// returns its Sum, the chunks, and the proof of each chunk.
+func hashFile(name string, data []byte) (string, [][]byte, [][]string) {
+	size := int64(len(data))
+	var chunks, leaves [][]byte
+	for len(data) > 0 {
+		b := data
+		if len(b) > chunkSize {
+			b = b[:chunkSize]
+		}
+		data = data[len(b):]
+		chunks = append(chunks, b)
+		leaves = append(leaves, sha256Sum(b))
+	}
+	root, proofs := merkleTree(leaves)
+	return fileSum(name, size, root), chunks, proofs
+}
+
+// fileSum returns the Sum of a file with the given name and size whose
+// chunks hash to the Merkle root root.
+func fileSum(name string, size int64, root []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n", name, size)
+	h.Write(root)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// merkleTree returns the root of the Merkle tree over the given chunk hashes,
+// and the proof of each chunk: the hex hashes of its siblings on the way up
+// to the root. A node without a sibling moves up a level unchanged.
+func merkleTree(leaves [][]byte) ([]byte, [][]string) {
+	proofs := make([][]string, len(leaves))
+	level := leaves
+	for shift := 0; len(level) > 1; shift++ {
+		for i := range leaves {
+			if sib := i>>shift ^ 1; sib < len(level) {
+				proofs[i] = append(proofs[i], hex.EncodeToString(level[sib]))
+			}
+		}
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, sha256Sum(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+	}
+	return level[0], proofs
+}
+
+// merkleRoot returns the root of the Merkle tree over n chunks given by the
+// hash of the chunk at index i and its proof, or nil if the proof doesn't fit
+// the tree.
+func merkleRoot(leaf []byte, i, n int, proof []string) []byte {
+	h := leaf
+	for ; n > 1; i, n = i/2, (n+1)/2 {
+		if i^1 >= n {
+			continue // No sibling at this level.
+		}
+		if len(proof) == 0 {
+			return nil
+		}
+		sib, err := hex.DecodeString(proof[0])
+		if err != nil {
+			return nil
+		}
+		proof = proof[1:]
+		if i%2 == 0 {
+			h = sha256Sum(h, sib)
+		} else {
+			h = sha256Sum(sib, h)
+		}
+	}
+	if len(proof) > 0 {
+		return nil
+	}
+	return h
+}
+
+// sha256Sum returns the SHA-256 of the concatenation of l.
+func sha256Sum(l ...[]byte) []byte {
+	h := sha256.New()
+	for _, b := range l {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// chunkID returns the message ID of the chunk at index i of the file with
+// the given hash.
+func chunkID(sum string, i int) string {
+	h := sha256.Sum256([]byte(sum + ":" + strconv.Itoa(i)))
+	return hex.EncodeToString(h[:idLen/2])
+}
+
+// chunkData checks a chunk message against its description and the hash of
+// its file, and returns the chunk's data.
+func chunkData(m Message) ([]byte, error) {
+	f := m.File
+	if m.ID != chunkID(f.Sum, f.Index) {
+		return nil, errors.New("wrong ID")
+	}
+	b, err := base64.StdEncoding.DecodeString(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	want := chunkSize
+	if f.Index == f.Chunks-1 {
+		want = int(f.Size) - f.Index*chunkSize
+	}
+	if len(b) != want {
+		return nil, fmt.Errorf("%d bytes, want %d", len(b), want)
+	}
+	leaf := sha256Sum(b)
+	if hex.EncodeToString(leaf) != f.ChunkSum {
+		return nil, errors.New("wrong hash")
+	}
+	if root := merkleRoot(leaf, f.Index, f.Chunks, f.Proof); root == nil || fileSum(f.Name, f.Size, root) != f.Sum {
+		return nil, errors.New("not part of the file")
+	}
+	return b, nil
+}
+
+// receiveChunk handles a chunk of a shared file received from a peer.
+func (n *Node) receiveChunk(m Message, from string) {
+	duplicate := func() {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		if n.cfg.Mode == Plumtree {
+			n.prune(from)
+		}
+	}
+	if n.seen.Has(m.ID) && !n.files.missing(m) {
+		duplicate()
+		return
+	}
+	if _, err := chunkData(m); err != nil {
+		atomic.AddInt64(&n.stats.BadFrames, 1)
+		n.log.Warn("bad chunk", util.LogPeer, from, util.LogOrigin, m.Addr, util.LogID, m.ID, "file", m.File.Name, "index", m.File.Index, util.LogErr, err)
+		return
+	}
+	// The chunks of a file take a single token from the bucket of its
+	// origin: the first one to arrive.
+	if n.files.has(m.File.Sum) {
+		if n.limits.penalised(m.Addr) {
+			atomic.AddInt64(&n.stats.Limited, 1)
+			return
+		}
+	} else if !n.withinLimits(m, from) {
+		return
+	}
+	if n.Seen(m.ID) && !n.files.missing(m) {
+		duplicate()
+		return
+	}
+	n.log.Debug("received chunk", util.LogPeer, from, util.LogOrigin, m.Addr, util.LogID, m.ID, "file", m.File.Name, "index", m.File.Index, "chunks", m.File.Chunks)
+	t := n.files.add(m.File.header(), m.Addr, m.Nick)
+	m = n.hop(m)
+	if n.files.put(t, m) {
+		n.saveFile(t)
+	} else {
+		n.files.watch(t, n.cfg.Clock, func() { n.resumeFile(t) })
+	}
+	if n.cfg.Mode == Plumtree {
+		n.tree.arrived(m.ID, from)
+	}
+	n.relay(m, from)
+}
+
+// resumeFile asks a random peer for the chunks of t still missing, unless
+// it's complete or has stopped making progress.
+func (n *Node) resumeFile(t *transfer) {
+	ids, ok := n.files.retry(t)
+	if !ok {
+		n.log.Warn("giving up on file", util.LogOrigin, t.addr, "file", t.f.Name, "missing", len(ids), "chunks", t.f.Chunks)
+		n.dropFile(t)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if len(ids) > maxIDs {
+		ids = ids[:maxIDs]
+	}
+	if addrs := n.peers.Addrs(); len(addrs) > 0 {
+		addr := addrs[rand.Intn(len(addrs))]
+		if pc := n.peers.get(addr); pc != nil {
+			n.logOut(addr).Debug("asking for missing chunks", "file", t.f.Name, "count", len(ids))
+			n.limits.ask(addr, len(ids))
+			n.send(pc, Message{Kind: KindPull, Addr: n.self, IDs: ids})
+		}
+	}
+	n.files.watch(t, n.cfg.Clock, func() { n.resumeFile(t) })
+}
+
+// saveFile checks the complete file t against its hash and writes it to
+// Config.Downloads.
+func (n *Node) saveFile(t *transfer) {
+	data := n.files.data(t)
+	if sum, _, _ := hashFile(t.f.Name, data); sum != t.f.Sum {
+		n.log.Warn("file doesn't match its hash, dropped", util.LogOrigin, t.addr, "file", t.f.Name)
+		n.dropFile(t)
+		return
+	}
+	n.log.Info("received file", util.LogOrigin, t.addr, "file", t.f.Name, "size", t.f.Size)
+	if n.cfg.Downloads == "" {
+		return
+	}
+	path, err := writeUnique(n.cfg.Downloads, t.f.Name, data)
+	if err != nil {
+		n.log.Error("saving file failed", util.LogOrigin, t.addr, "file", t.f.Name, util.LogErr, err)
+		return
+	}
+	if n.cfg.Downloaded != nil {
+		n.cfg.Downloaded(Download{Name: t.f.Name, Path: path, Size: t.f.Size, Addr: t.addr, Nick: t.nick})
+	}
+}
+
+// dropFile forgets the transfer t, which failed, and the IDs of its chunks,
+// so that the file can be received if it's sent again.
+func (n *Node) dropFile(t *transfer) {
+	n.files.remove(t)
+	for i := 0; i < t.f.Chunks; i++ {
+		n.seen.Forget(chunkID(t.f.Sum, i))
+	}
+}
+
+// writeUnique writes data to a new file called name in dir, adding a number
+// to the name if it's taken, and returns its path.
+func writeUnique(dir, name string, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		return path, nil
+	}
+}
+
+// lookup returns the message with the given ID from the history or the
+// chunks of the shared files kept in memory.
+func (n *Node) lookup(id string) (Message, bool) {
+	if m, ok := n.history.Get(id); ok {
+		return m, true
+	}
+	return n.files.get(id)
+}
+
+// transfer is a shared file being received, or kept to answer pulls.
+type transfer struct {
+	f     FileChunk // header of the file
+	addr  string    // node that sent it
+	nick  string
+	msgs  []Message // chunk messages by index; missing ones have no ID
+	have  int       // chunks received
+	seen  int       // have at the last resume
+	tries int       // resumes in a row that brought no new chunks
+	timer transport.Timer
+}
+
+// fileStore keeps the chunks of the most recent shared files.
+type fileStore struct {
+	mu    sync.Mutex
+	files map[string]*transfer // by Sum
+	order []string             // Sums, oldest first
+	ids   map[string]*transfer // by chunk message ID
+}
+
+func newFileStore() *fileStore {
+	return &fileStore{files: make(map[string]*transfer), ids: make(map[string]*transfer)}
+}
+
+// add returns the transfer for the file described by f, creating it, and
+// dropping the oldest file if there are too many, if it's new.
+func (s *fileStore) add(f FileChunk, addr, nick string) *transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.files[f.Sum]; ok {
+		return t
+	}
+	if len(s.order) >= maxFiles {
+		s.removeLocked(s.files[s.order[0]])
+	}
+	t := &transfer{f: f, addr: addr, nick: nick, msgs: make([]Message, f.Chunks)}
+	s.files[f.Sum] = t
+	s.order = append(s.order, f.Sum)
+	return t
+}
+
+// put adds the chunk message m to t, and reports whether that completed it.
+func (s *fileStore) put(t *transfer, m Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := m.File.Index
+	if s.files[t.f.Sum] != t || t.msgs[i].ID != "" {
+		return false // Dropped, or a duplicate.
+	}
+	t.msgs[i] = m
+	t.have++
+	s.ids[m.ID] = t
+	if t.have < len(t.msgs) {
+		return false
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	return true
+}
+
+// has reports whether the file with the given Sum is being received or kept.
+func (s *fileStore) has(sum string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[sum]
+	return ok
+}
+
+// missing reports whether m is a chunk of a file being received that hasn't
+// arrived yet.
+func (s *fileStore) missing(m Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.files[m.File.Sum]
+	return ok && m.File.Index < len(t.msgs) && t.msgs[m.File.Index].ID == ""
+}
+
+// watch arranges for resume to be called after fileResume, unless t is
+// complete or already watched.
+func (s *fileStore) watch(t *transfer, c transport.Clock, resume func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[t.f.Sum] != t || t.have == len(t.msgs) {
+		return
+	}
+	if t.timer == nil {
+		t.timer = c.AfterFunc(fileResume, func() {
+			s.mu.Lock()
+			t.timer = nil
+			s.mu.Unlock()
+			resume()
+		})
+	}
+}
+
+// retry returns the IDs of the chunks t is missing, and reports whether it
+// is worth asking for them again.
+func (s *fileStore) retry(t *transfer) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for i, m := range t.msgs {
+		if m.ID == "" {
+			ids = append(ids, chunkID(t.f.Sum, i))
+		}
+	}
+	if t.have > t.seen {
+		t.seen, t.tries = t.have, 0
+	}
+	t.tries++
+	return ids, t.tries <= fileRetries && s.files[t.f.Sum] == t
+}
+
+// data returns the contents of the complete file t.
+func (s *fileStore) data(t *transfer) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b bytes.Buffer
+	for _, m := range t.msgs {
+		d, _ := base64.StdEncoding.DecodeString(m.Body)
+		b.Write(d)
+	}
+	return b.Bytes()
+}
+
+// get returns the chunk message with the given ID, if it's kept.
+func (s *fileStore) get(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ids[id]
+	if !ok {
+		return Message{}, false
+	}
+	for _, m := range t.msgs {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Message{}, false
+}
+
+func (s *fileStore) remove(t *transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(t)
+}
+
+// removeLocked forgets t. The caller must hold s.mu.
+func (s *fileStore) removeLocked(t *transfer) {
+	if t == nil || s.files[t.f.Sum] != t {
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	delete(s.files, t.f.Sum)
+	for i, sum := range s.order {
+		if sum == t.f.Sum {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	for _, m := range t.msgs {
+		delete(s.ids, m.ID)
+	}
+}
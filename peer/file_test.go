@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+// writeTestFile writes size random bytes to a file called name in a new
+// directory and returns its path and contents.
+func writeTestFile(t *testing.T, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// checkDownloads waits for want downloads and checks that they hold data.
+func checkDownloads(t *testing.T, downloads <-chan Download, want int, data []byte, timeout time.Duration) {
+	deadline := time.After(timeout)
+	for i := 0; i < want; i++ {
+		select {
+		case d := <-downloads:
+			got, err := os.ReadFile(d.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: got %d bytes, want the %d bytes sent", d.Path, len(got), len(data))
+			}
+		case <-deadline:
+			t.Fatalf("file downloaded by %d nodes, want %d", i, want)
+		}
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	const n = 3
+	downloads := make(chan Download, n)
+	nodes, _ := startMesh(t, n, Config{
+		Codec:      CodecBinary,
+		Downloads:  t.TempDir(),
+		Downloaded: func(d Download) { downloads <- d },
+	})
+	path, data := writeTestFile(t, "log.txt", 3*chunkSize+100)
+	f, err := nodes[0].SendFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "log.txt" || f.Chunks != 4 {
+		t.Errorf("SendFile returned %+v, want 4 chunks of log.txt", f)
+	}
+	// Both receivers share a download directory, so one copy is renamed.
+	checkDownloads(t, downloads, n-1, data, 5*time.Second)
+	for _, name := range []string{"log.txt", "log-1.txt"} {
+		if _, err := os.Stat(filepath.Join(nodes[0].cfg.Downloads, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileResume(t *testing.T) {
+	clock := transport.NewFakeClock()
+	net := transport.NewMemoryClock(clock)
+	// Lose some of the chunks, and let b ask for them again.
+	net.SetLoss(0.3, 1)
+	downloads := make(chan Download, 1)
+	nodes, _ := startMesh(t, 2, Config{
+		Transport:  net,
+		Clock:      clock,
+		Downloads:  t.TempDir(),
+		Downloaded: func(d Download) { downloads <- d },
+	})
+	path, data := writeTestFile(t, "config.json", 10*chunkSize)
+	if _, err := nodes[0].SendFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20 && len(downloads) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		clock.Advance(fileResume)
+	}
+	checkDownloads(t, downloads, 1, data, time.Second)
+}
+
+func TestSendFileErrors(t *testing.T) {
+	n := newTestNode(t, Config{})
+	empty, _ := writeTestFile(t, "empty", 0)
+	big, _ := writeTestFile(t, "big", maxFileSize+1)
+	hidden, _ := writeTestFile(t, ".hidden", 1)
+	for _, path := range []string{empty, big, hidden, filepath.Join(t.TempDir(), "missing")} {
+		if _, err := n.SendFile(path); err == nil {
+			t.Errorf("SendFile(%q) succeeded, want an error", filepath.Base(path))
+		}
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, sha256Sum([]byte{byte(i)}))
+		}
+		root, proofs := merkleTree(leaves)
+		for i, leaf := range leaves {
+			if got := merkleRoot(leaf, i, n, proofs[i]); !bytes.Equal(got, root) {
+				t.Errorf("%d leaves: proof of leaf %d gives root %x, want %x", n, i, got, root)
+			}
+			if got := merkleRoot(leaves[(i+1)%n], i, n, proofs[i]); n > 1 && bytes.Equal(got, root) {
+				t.Errorf("%d leaves: proof of leaf %d accepted another leaf", n, i)
+			}
+		}
+	}
+}
+
+func TestForgedChunk(t *testing.T) {
+	downloads := make(chan Download, 1)
+	n := newTestNode(t, Config{
+		NoDiscover: true,
+		Downloads:  t.TempDir(),
+		Downloaded: func(d Download) { downloads <- d },
+	})
+	// A node without peers keeps the chunks of the files it sends.
+	path, data := writeTestFile(t, "notes.txt", 2*chunkSize)
+	sender := newTestNode(t, Config{})
+	f, err := sender.SendFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []Message
+	for i := 0; i < f.Chunks; i++ {
+		m, ok := sender.files.get(chunkID(f.Sum, i))
+		if !ok {
+			t.Fatalf("chunk %d not kept by its sender", i)
+		}
+		chunks = append(chunks, m)
+	}
+
+	// A chunk with the right ID and a hash of its own is refused.
+	forged := chunks[0]
+	fc := *forged.File
+	bad := make([]byte, chunkSize)
+	fc.ChunkSum = hex.EncodeToString(sha256Sum(bad))
+	forged.File, forged.Body = &fc, base64.StdEncoding.EncodeToString(bad)
+	n.receive(forged, "")
+	if s := n.Stats(); s.BadFrames != 1 {
+		t.Errorf("BadFrames = %d after a forged chunk, want 1", s.BadFrames)
+	}
+	for _, m := range chunks {
+		n.receive(m, "")
+	}
+	checkDownloads(t, downloads, 1, data, time.Second)
+
+	// A node that gives up on a file takes its chunks again.
+	n.dropFile(n.files.add(f, sender.Addr(), ""))
+	if n.seen.Has(chunks[0].ID) {
+		t.Error("chunk still seen after its file was dropped")
+	}
+}
@@ -0,0 +1,63 @@
+package peer
+
+import "math/rand"
+
+// pushPull periodically starts a push-pull round with a random peer.
+func (n *Node) pushPull() {
+	for range n.cfg.Clock.Tick(n.cfg.PushPull) {
+		addrs := n.peers.Addrs()
+		if len(addrs) == 0 {
+			continue
+		}
+		pc := n.peers.get(addrs[rand.Intn(len(addrs))])
+		if pc == nil {
+			continue // Peer went away.
+		}
+		// The peer answers with up to its history.
+		n.limits.ask(pc.addr, n.cfg.History)
+		n.send(pc, Message{Kind: KindDigest, Addr: n.self, IDs: n.history.IDs()})
+	}
+}
+
+// handleDigest answers a push-pull round started by the peer at from: it
+// pushes the recent messages the peer did not list, and pulls the listed
+// messages this node has not seen.
+func (n *Node) handleDigest(m Message, from string) {
+	pc := n.peers.get(from)
+	if pc == nil {
+		return // Not connected yet; the peer will try again next round.
+	}
+	have := make(map[string]bool, len(m.IDs))
+	for _, id := range m.IDs {
+		have[id] = true
+	}
+	for _, hm := range n.history.Messages() {
+		if !have[hm.ID] {
+			n.send(pc, hm)
+		}
+	}
+	var missing []string
+	for _, id := range m.IDs {
+		if !n.seen.Has(id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		n.limits.ask(from, len(missing))
+		n.send(pc, Message{Kind: KindPull, Addr: n.self, IDs: missing})
+	}
+}
+
+// handlePull sends the peer at from the requested messages that are still in
+// history, or kept as chunks of a shared file.
+func (n *Node) handlePull(m Message, from string) {
+	pc := n.peers.get(from)
+	if pc == nil {
+		return
+	}
+	for _, id := range m.IDs {
+		if hm, ok := n.lookup(id); ok {
+			n.send(pc, hm)
+		}
+	}
+}
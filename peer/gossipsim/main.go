@@ -0,0 +1,160 @@
+// The gossipsim command estimates how well fanout-limited gossip delivers a
+// message compared to flooding, and how many messages each strategy costs.
+//
+// It models a full mesh of -n nodes. A message starts at one node; every node
+// that receives it for the first time relays it to -fanout random peers, and
+// each transmission is lost with probability -loss. After relaying stops,
+// -rounds push-pull rounds are run in which every node exchanges a digest
+// with one random peer and both sides fill in what the other is missing.
+// Flooding is the same process with a fanout of n-1 and no push-pull rounds.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	nodes  = flag.Int("n", 100, "number of nodes in the mesh")
+	fanout = flag.Int("fanout", 0, "fanout to simulate (0 simulates a range of fanouts)")
+	loss   = flag.Float64("loss", 0.01, "probability that a transmission is lost")
+	rounds = flag.Int("rounds", 2, "number of push-pull rounds after relaying stops")
+	trials = flag.Int("trials", 200, "number of messages simulated per row")
+	seed   = flag.Int64("seed", 0, "random seed (0 uses the current time)")
+)
+
+// result summarises the trials of one strategy.
+type result struct {
+	delivery float64 // mean fraction of nodes that received the message
+	complete float64 // fraction of trials in which every node received it
+	messages float64 // mean messages sent per node, digests included
+}
+
+func main() {
+	flag.Parse()
+	switch {
+	case *nodes < 2:
+		usage("-n must be at least 2")
+	case *fanout < 0:
+		usage("-fanout must not be negative")
+	case *loss < 0 || *loss > 1:
+		usage("-loss must be between 0 and 1")
+	case *rounds < 0:
+		usage("-rounds must not be negative")
+	case *trials < 1:
+		usage("-trials must be at least 1")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(*seed))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "strategy\tfanout\trounds\tdelivery\tcomplete\tmsgs/node\t")
+	row := func(name string, k, rounds int, res result) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.4f\t%.3f\t%.2f\t\n",
+			name, k, rounds, res.delivery, res.complete, res.messages)
+	}
+
+	row("flood", *nodes-1, 0, simulate(r, *nodes-1, 0))
+	fanouts := []int{*fanout}
+	if *fanout == 0 {
+		fanouts = []int{1, 2, 3, 4, 6, 8}
+	}
+	for _, k := range fanouts {
+		if k >= *nodes {
+			continue
+		}
+		row("gossip", k, 0, simulate(r, k, 0))
+		if *rounds > 0 {
+			row("gossip", k, *rounds, simulate(r, k, *rounds))
+		}
+	}
+	w.Flush()
+}
+
+// usage reports a bad flag and the flags accepted, and exits.
+func usage(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gossipsim: "+format+"\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// simulate runs the configured number of trials with the given fanout and
+// number of push-pull rounds.
+func simulate(r *rand.Rand, k, rounds int) result {
+	n := *nodes
+	var res result
+	for t := 0; t < *trials; t++ {
+		have := make([]bool, n)
+		sent := 0
+		// Relay phase: breadth-first infection from node 0.
+		have[0] = true
+		queue := []int{0}
+		for len(queue) > 0 {
+			from := queue[0]
+			queue = queue[1:]
+			for _, to := range pick(r, n, from, k) {
+				sent++
+				if r.Float64() < *loss || have[to] {
+					continue
+				}
+				have[to] = true
+				queue = append(queue, to)
+			}
+		}
+		// Push-pull phase: each node exchanges a digest with one peer.
+		for i := 0; i < rounds; i++ {
+			for from := 0; from < n; from++ {
+				to := pick(r, n, from, 1)[0]
+				sent++ // digest
+				if r.Float64() < *loss || have[from] == have[to] {
+					continue
+				}
+				sent++ // the missing message, pushed or pulled
+				if r.Float64() < *loss {
+					continue
+				}
+				have[from], have[to] = true, true
+			}
+		}
+
+		got := 0
+		for _, ok := range have {
+			if ok {
+				got++
+			}
+		}
+		res.delivery += float64(got) / float64(n)
+		if got == n {
+			res.complete++
+		}
+		res.messages += float64(sent) / float64(n)
+	}
+	res.delivery /= float64(*trials)
+	res.complete /= float64(*trials)
+	res.messages /= float64(*trials)
+	return res
+}
+
+// pick returns k distinct random nodes out of n, excluding self.
+func pick(r *rand.Rand, n, self, k int) []int {
+	if k > n-1 {
+		k = n - 1
+	}
+	l := make([]int, 0, n-1)
+	for i := 0; i < n; i++ {
+		if i != self {
+			l = append(l, i)
+		}
+	}
+	for i := 0; i < k; i++ {
+		j := i + r.Intn(len(l)-i)
+		l[i], l[j] = l[j], l[i]
+	}
+	return l[:k]
+}
@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// Node identity.
+//
+// Addr changes whenever a node restarts, so chat messages also carry From,
+// the node's ID, which programs keep across restarts with LoadID. Nicknames
+// are chosen freely; when two nodes pick the same one, Format tells them
+// apart by the start of their IDs.
+
+const (
+	shortIDLen = 4    // hex digits of From shown after a shared nickname
+	maxNames   = 4096 // nickname and ID pairs remembered
+)
+
+// LoadID returns the node ID stored in the file at path, creating the file
+// with a new random ID if it doesn't exist.
+func LoadID(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if !validHex(id, idLen) {
+			return "", fmt.Errorf("%s: not a node ID: %q", path, id)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id := util.RandomID()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ID returns the ID of the node, sent as From in its chat messages.
+func (n *Node) ID() string { return n.id }
+
+// Format returns the text shown for a chat message: "nick (addr): body", or
+// "addr: body" if the sender has no nickname. A nickname used by more than
+// one node is followed by a # and the start of the sender's ID.
+func (n *Node) Format(m Message) string {
+	if m.Nick == "" {
+		return m.Addr + ": " + m.Body
+	}
+	return n.names.display(m.Nick, m.From) + " (" + m.Addr + "): " + m.Body
+}
+
+// NickTaken reports whether another node has been seen using nick.
+func (n *Node) NickTaken(nick string) bool {
+	return n.names.usedByOther(nick, n.id)
+}
+
+// names records the IDs of the nodes using each nickname.
+type names struct {
+	mu  sync.Mutex
+	ids map[string][]string // by nickname
+	n   int                 // pairs recorded
+}
+
+func newNames() *names {
+	return &names{ids: make(map[string][]string)}
+}
+
+// add records that the node with the given ID uses nick, and reports whether
+// another node already used it.
+func (s *names) add(nick, id string) bool {
+	if nick == "" || id == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.ids[nick]
+	for _, x := range l {
+		if x == id {
+			return false
+		}
+	}
+	if s.n >= maxNames {
+		// Start afresh rather than grow without bound.
+		s.ids, s.n = make(map[string][]string), 0
+		l = nil
+	}
+	s.ids[nick] = append(l, id)
+	s.n++
+	return len(l) > 0
+}
+
+// display returns nick as shown for the node with the given ID.
+func (s *names) display(nick, id string) string {
+	s.mu.Lock()
+	shared := len(s.ids[nick]) > 1
+	s.mu.Unlock()
+	if !shared || len(id) < shortIDLen {
+		return nick
+	}
+	return nick + "#" + id[:shortIDLen]
+}
+
+// usedByOther reports whether a node other than the one with the given ID
+// uses nick.
+func (s *names) usedByOther(nick, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, x := range s.ids[nick] {
+		if x != id {
+			return true
+		}
+	}
+	return false
+}
+
+// learnName records the nickname of the sender of m, and warns when it's
+// already used by another node.
+func (n *Node) learnName(m Message) {
+	if n.names.add(m.Nick, m.From) {
+		n.log.Warn("nickname used by more than one node", util.LogOrigin, m.Addr, "nick", m.Nick, "from", m.From)
+	}
+}
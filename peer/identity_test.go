@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "node_id")
+	id, err := LoadID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validHex(id, idLen) {
+		t.Errorf("LoadID made %q, want %d hex digits", id, idLen)
+	}
+	again, err := LoadID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != id {
+		t.Errorf("LoadID = %q after a restart, want %q", again, id)
+	}
+	os.WriteFile(path, []byte("not an id\n"), 0o600)
+	if _, err := LoadID(path); err == nil {
+		t.Error("LoadID accepted a corrupt file")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	const alice, bob, eve = "0123456789abcdef", "fedcba9876543210", "00112233aabbccdd"
+	n := newTestNode(t, Config{ID: alice})
+	if err := n.SetNick("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SetNick("bad\x1b[2J"); err != ErrBadNick {
+		t.Errorf("SetNick of a control sequence = %v, want ErrBadNick", err)
+	}
+	n.learnName(Message{Nick: "bob", From: bob})
+	tests := []struct {
+		m    Message
+		want string
+	}{
+		{Message{Addr: "10.0.0.2:4000", Nick: "bob", From: bob, Body: "hi"}, "bob (10.0.0.2:4000): hi"},
+		{Message{Addr: "10.0.0.3:4000", Body: "hi"}, "10.0.0.3:4000: hi"},
+		{Message{Addr: "10.0.0.1:4000", Nick: "alice", From: alice, Body: "hi"}, "alice (10.0.0.1:4000): hi"},
+	}
+	for _, tt := range tests {
+		if got := n.Format(tt.m); got != tt.want {
+			t.Errorf("Format(%+v) = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+
+	// Once eve calls herself alice too, both show their IDs.
+	if n.NickTaken("alice") {
+		t.Error("NickTaken(alice) before anyone else used it")
+	}
+	n.learnName(Message{Nick: "alice", From: eve})
+	if !n.NickTaken("alice") {
+		t.Error("NickTaken(alice) = false after eve used it")
+	}
+	for from, want := range map[string]string{alice: "alice#0123 (a:1): hi", eve: "alice#0011 (a:1): hi"} {
+		if got := n.Format(Message{Addr: "a:1", Nick: "alice", From: from, Body: "hi"}); got != want {
+			t.Errorf("Format from %s = %q, want %q", from, got, want)
+		}
+	}
+}
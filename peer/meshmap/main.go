@@ -0,0 +1,183 @@
+// The meshmap command crawls a mesh of nodes from a seed address and prints
+// its graph.
+//
+// It asks the seed for its neighbours with a topology query, then asks each
+// neighbour in turn, until it has asked every node it heard of or -max of
+// them. Each connection is an edge from the node that dialled it to the node
+// that accepted it, labelled with its age; two nodes that dialled each other
+// are joined by an edge each way. Nodes that didn't answer are drawn dashed.
+//
+// The graph is printed in the DOT language of Graphviz, for
+//
+//	meshmap -seed host:port | dot -Tsvg > mesh.svg
+//
+// or, with -json, as JSON.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+var (
+	seed      = flag.String("seed", "", "host:port of the first node to ask")
+	transName = flag.String("transport", "tcp", "how to reach the nodes: "+strings.Join(transport.Remote, ", "))
+	timeout   = flag.Duration("timeout", 5*time.Second, "how long to wait for each node to answer")
+	maxNodes  = flag.Int("max", 1000, "number of nodes to ask at most")
+	parallel  = flag.Int("parallel", 16, "number of nodes asked at once")
+	asJSON    = flag.Bool("json", false, "print the graph as JSON instead of DOT")
+)
+
+// Graph is the map of a mesh.
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+}
+
+// Node is a node of the mesh.
+type Node struct {
+	Addr  string
+	Nick  string `json:",omitempty"`
+	ID    string `json:",omitempty"`
+	Error string `json:",omitempty"` // why the node didn't answer
+}
+
+// Edge is a connection from the node that dialled it to the node that
+// accepted it.
+type Edge struct {
+	From, To string
+	Age      time.Duration // as reported by either end
+}
+
+func main() {
+	flag.Parse()
+	if *seed == "" {
+		fatalf("-seed is required")
+	}
+	tr, err := transport.NewRemote(*transName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	g := crawl(tr, *seed)
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "\t")
+		err = e.Encode(g)
+	} else {
+		err = writeDOT(os.Stdout, g)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "meshmap: "+format+"\n", args...)
+	os.Exit(2)
+}
+
+// crawl asks the nodes reachable from seed for their neighbours and returns
+// the graph of their answers.
+func crawl(tr transport.Transport, seed string) Graph {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		nodes   = make(map[string]*Node)
+		edges   = make(map[[2]string]time.Duration)
+		limit   = make(chan bool, *parallel)
+		explore func(addr string)
+	)
+	// explore asks addr for its neighbours, unless it has already been
+	// asked, and then asks them. The caller must hold mu.
+	explore = func(addr string) {
+		if nodes[addr] != nil || len(nodes) >= *maxNodes {
+			return
+		}
+		nd := &Node{Addr: addr}
+		nodes[addr] = nd
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit <- true
+			m, err := peer.QueryTopology(tr, addr, *timeout)
+			<-limit
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				nd.Error = err.Error()
+				return
+			}
+			nd.Nick, nd.ID = m.Nick, m.From
+			for _, l := range m.Links {
+				e := [2]string{addr, l.Addr}
+				if l.Dir == util.DirIn {
+					e = [2]string{l.Addr, addr}
+				}
+				edges[e] = l.Age
+				explore(l.Addr)
+			}
+		}()
+	}
+	mu.Lock()
+	explore(seed)
+	mu.Unlock()
+	wg.Wait()
+
+	g := Graph{Nodes: []Node{}, Edges: []Edge{}}
+	for _, nd := range nodes {
+		g.Nodes = append(g.Nodes, *nd)
+	}
+	for e, age := range edges {
+		if nodes[e[0]] != nil && nodes[e[1]] != nil {
+			g.Edges = append(g.Edges, Edge{From: e[0], To: e[1], Age: age})
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Addr < g.Nodes[j].Addr })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// writeDOT writes g to w in the DOT language.
+func writeDOT(w io.Writer, g Graph) error {
+	var b strings.Builder
+	b.WriteString("digraph mesh {\n\tnode [shape=box];\n")
+	for _, nd := range g.Nodes {
+		label := nd.Addr
+		if nd.Nick != "" {
+			label = nd.Nick + "\n" + nd.Addr
+		}
+		style := ""
+		if nd.Error != "" {
+			style = ", style=dashed, tooltip=" + quote(nd.Error)
+		}
+		fmt.Fprintf(&b, "\t%s [label=%s%s];\n", quote(nd.Addr), quote(label), style)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s [label=%s];\n", quote(e.From), quote(e.To), quote(e.Age.Round(time.Second).String()))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quote returns s as a DOT string.
+func quote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,372 @@
+// The meshsim command runs a mesh of real nodes in one process and measures
+// how well it delivers messages.
+//
+// It starts -n nodes of the peer package on an in-memory network or on
+// loopback TCP, connected in the shape given by -topology:
+//
+//	line    each node connects to the next
+//	ring    a line whose ends are connected
+//	star    every node connects to node 0
+//	random  each node connects to a random earlier node, and to more random
+//	        nodes until it has about -degree neighbours
+//
+// Nodes keep to their neighbours instead of connecting to every node they
+// hear from. Random live nodes then send -messages messages, -interval apart,
+// while -churn randomly chosen nodes leave the mesh and are replaced by new
+// nodes in the same place. After waiting -settle for the last deliveries, it
+// reports the fraction of the expected deliveries that happened, the number
+// of duplicate copies received, and percentiles of the time from sending to
+// delivery, as a table or, with -json, as JSON. A message is expected to
+// reach the nodes that were connected when it was sent, except those that
+// leave before it does.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+var (
+	nodes    = flag.Int("n", 50, "number of nodes in the mesh")
+	topology = flag.String("topology", "random", "shape of the mesh: line, ring, star or random")
+	degree   = flag.Int("degree", 3, "neighbours per node in the random topology")
+	network  = flag.String("net", "mem", "network: mem (in memory) or tcp (loopback)")
+	latency  = flag.Duration("latency", 5*time.Millisecond, "delay of each packet on the in-memory network")
+	loss     = flag.Float64("loss", 0, "probability that a packet is lost on the in-memory network")
+	mode     = flag.String("mode", "flood", "relay mode: flood, gossip or plumtree")
+	fanout   = flag.Int("fanout", 3, "number of peers each message is relayed to in gossip mode")
+	pushPull = flag.Duration("pushpull", time.Second, "interval between push-pull rounds in gossip mode")
+	messages = flag.Int("messages", 20, "number of messages to send")
+	interval = flag.Duration("interval", 50*time.Millisecond, "time between messages")
+	churn    = flag.Int("churn", 0, "number of nodes replaced while messages are sent")
+	settle   = flag.Duration("settle", 2*time.Second, "time to wait for deliveries after the last message")
+	seed     = flag.Int64("seed", 0, "random seed (0 uses the current time)")
+	asJSON   = flag.Bool("json", false, "print the report as JSON")
+	verbose  = flag.Bool("v", false, "show the log output of the nodes")
+)
+
+// Report is the outcome of a simulation.
+type Report struct {
+	Nodes     int
+	Topology  string
+	Mode      string
+	Messages  int
+	Churn     int
+	Expected  int     // deliveries to the nodes present for each message
+	Delivered int     // deliveries that happened
+	Ratio     float64 // Delivered / Expected
+	// Duplicates is the number of copies of messages received by nodes
+	// that had already seen them.
+	Duplicates int64
+	// LatencyMS holds percentiles of the time from sending to delivery,
+	// in milliseconds.
+	LatencyMS map[string]float64
+}
+
+// sent is a message sent during the simulation.
+type sent struct {
+	at       time.Time
+	expected map[*peer.Node]bool // nodes expected to deliver it
+}
+
+// sim is a running simulation. Nodes live in slots; churn replaces the node
+// in a slot with a new one.
+type sim struct {
+	net   *transport.Memory // nil for TCP
+	r     *rand.Rand
+	edges [][]int // neighbours of each slot
+
+	mu        sync.Mutex
+	slots     []*peer.Node
+	retired   []*peer.Node // nodes replaced by churn
+	sent      map[string]*sent
+	delivered int
+	latencies []time.Duration
+}
+
+func main() {
+	flag.Parse()
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	w, level := io.Discard, slog.LevelError
+	if *verbose {
+		w, level = os.Stderr, slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
+	switch peer.Mode(*mode) {
+	case peer.Flood, peer.Gossip, peer.Plumtree:
+	default:
+		fatalf("unknown -mode %q", *mode)
+	}
+	if *nodes < 2 {
+		fatalf("-n must be at least 2")
+	}
+
+	s := &sim{
+		r:     rand.New(rand.NewSource(*seed)),
+		slots: make([]*peer.Node, *nodes),
+		sent:  make(map[string]*sent),
+	}
+	switch *network {
+	case "mem":
+		s.net = transport.NewMemory()
+		s.net.SetLatency(*latency)
+		s.net.SetLoss(*loss, *seed)
+	case "tcp":
+	default:
+		fatalf("unknown -net %q", *network)
+	}
+	var err error
+	if s.edges, err = edges(s.r, *topology, *nodes, *degree); err != nil {
+		fatalf("%v", err)
+	}
+
+	for i := range s.slots {
+		s.start(i)
+	}
+	for i := range s.slots {
+		s.connect(i)
+	}
+	time.Sleep(100 * time.Millisecond) // Let the connections settle.
+
+	// Spread the churn events among the messages.
+	churnAt := make(map[int]int)
+	for i := 0; i < *churn; i++ {
+		churnAt[s.r.Intn(*messages)]++
+	}
+	for i := 0; i < *messages; i++ {
+		for j := 0; j < churnAt[i]; j++ {
+			s.replace(s.r.Intn(*nodes))
+		}
+		s.send(s.r.Intn(*nodes), fmt.Sprintf("message %d", i))
+		time.Sleep(*interval)
+	}
+	time.Sleep(*settle)
+
+	rep := s.report()
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(rep); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+	printReport(rep)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "meshsim: "+format+"\n", args...)
+	os.Exit(2)
+}
+
+// edges returns the neighbours each of n nodes dials in the given topology.
+func edges(r *rand.Rand, topology string, n, degree int) ([][]int, error) {
+	e := make([][]int, n)
+	switch topology {
+	case "line", "ring":
+		for i := 0; i+1 < n; i++ {
+			e[i] = append(e[i], i+1)
+		}
+		if topology == "ring" && n > 2 {
+			e[n-1] = append(e[n-1], 0)
+		}
+	case "star":
+		for i := 1; i < n; i++ {
+			e[i] = append(e[i], 0)
+		}
+	case "random":
+		// A random tree keeps the mesh connected; the extra edges give
+		// each node about degree neighbours, counting both directions.
+		for i := 1; i < n; i++ {
+			e[i] = append(e[i], r.Intn(i))
+		}
+		for extra := n*degree/2 - (n - 1); extra > 0; extra-- {
+			a, b := r.Intn(n), r.Intn(n)
+			if a != b {
+				e[a] = append(e[a], b)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown -topology %q", topology)
+	}
+	return e, nil
+}
+
+// start starts a new node in slot i.
+func (s *sim) start(i int) {
+	var l net.Listener
+	var tr transport.Transport
+	var err error
+	if s.net != nil {
+		h := s.net.Host()
+		l, err = h.Listen()
+		tr = h
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		tr = transport.TCP
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var n *peer.Node
+	n = peer.New(l, peer.Config{
+		Mode:       peer.Mode(*mode),
+		Fanout:     *fanout,
+		PushPull:   *pushPull,
+		History:    *messages,
+		Transport:  tr,
+		NoDiscover: true,
+		Deliver:    func(m peer.Message) { s.deliver(n, m) },
+	})
+	go n.Serve()
+	s.mu.Lock()
+	s.slots[i] = n
+	s.mu.Unlock()
+}
+
+// connect makes the node in slot i dial its neighbours. They dial back when
+// they hear from it.
+func (s *sim) connect(i int) {
+	s.mu.Lock()
+	n := s.slots[i]
+	var addrs []string
+	for j := range s.slots {
+		for _, k := range s.edges[j] {
+			if j == i {
+				addrs = append(addrs, s.slots[k].Addr())
+			} else if k == i {
+				addrs = append(addrs, s.slots[j].Addr())
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, addr := range addrs {
+		go n.Dial(addr)
+	}
+}
+
+// replace stops the node in slot i and starts a new one in its place. The
+// messages the old node hasn't delivered yet are no longer expected of it.
+func (s *sim) replace(i int) {
+	s.mu.Lock()
+	old := s.slots[i]
+	s.retired = append(s.retired, old)
+	for _, sm := range s.sent {
+		delete(sm.expected, old)
+	}
+	s.mu.Unlock()
+	old.Close()
+	s.start(i)
+	s.connect(i)
+}
+
+// send sends a message from the node in slot i, and expects every other
+// node connected to the mesh at the time to deliver it. A node that has just
+// replaced another may still be dialling its neighbours.
+func (s *sim) send(i int, body string) {
+	s.mu.Lock()
+	n := s.slots[i]
+	expected := make(map[*peer.Node]bool)
+	for j, o := range s.slots {
+		if j != i && connected(o) {
+			expected[o] = true
+		}
+	}
+	// Deliveries wait for the lock, so the message is recorded before
+	// any of them.
+	defer s.mu.Unlock()
+	at := time.Now()
+	m := n.Send(body)
+	s.sent[m.ID] = &sent{at: at, expected: expected}
+}
+
+// connected reports whether n has a connection to a peer.
+func connected(n *peer.Node) bool {
+	for _, p := range n.Peers().Info() {
+		if p.Connected {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver records the delivery of m to node n.
+func (s *sim) deliver(n *peer.Node, m peer.Message) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sm, ok := s.sent[m.ID]
+	if !ok || !sm.expected[n] {
+		return // A node that joined later or left, or a message still being sent.
+	}
+	delete(sm.expected, n)
+	s.delivered++
+	s.latencies = append(s.latencies, now.Sub(sm.at))
+}
+
+func (s *sim) report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := Report{
+		Nodes:     *nodes,
+		Topology:  *topology,
+		Mode:      *mode,
+		Messages:  len(s.sent),
+		Churn:     len(s.retired),
+		Delivered: s.delivered,
+		LatencyMS: make(map[string]float64),
+	}
+	rep.Expected = s.delivered
+	for _, sm := range s.sent {
+		rep.Expected += len(sm.expected)
+	}
+	if rep.Expected > 0 {
+		rep.Ratio = float64(rep.Delivered) / float64(rep.Expected)
+	}
+	for _, n := range append(s.slots, s.retired...) {
+		rep.Duplicates += n.Stats().Duplicates
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	if l := s.latencies; len(l) > 0 {
+		for _, p := range []struct {
+			name string
+			q    float64
+		}{{"p50", 0.5}, {"p90", 0.9}, {"p99", 0.99}, {"max", 1}} {
+			d := l[int(p.q*float64(len(l)-1))]
+			rep.LatencyMS[p.name] = float64(d) / float64(time.Millisecond)
+		}
+	}
+	return rep
+}
+
+func printReport(rep Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "nodes\t%d\n", rep.Nodes)
+	fmt.Fprintf(w, "topology\t%s\n", rep.Topology)
+	fmt.Fprintf(w, "mode\t%s\n", rep.Mode)
+	fmt.Fprintf(w, "messages\t%d\n", rep.Messages)
+	fmt.Fprintf(w, "churn\t%d\n", rep.Churn)
+	fmt.Fprintf(w, "delivered\t%d/%d (%.4f)\n", rep.Delivered, rep.Expected, rep.Ratio)
+	fmt.Fprintf(w, "duplicates\t%d\n", rep.Duplicates)
+	for _, p := range []string{"p50", "p90", "p99", "max"} {
+		if d, ok := rep.LatencyMS[p]; ok {
+			fmt.Fprintf(w, "latency %s\t%.1fms\n", p, d)
+		}
+	}
+	w.Flush()
+}
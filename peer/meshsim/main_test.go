@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/peer"
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+func TestEdges(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, tt := range []struct {
+		topology string
+		want     [][]int
+	}{
+		{"line", [][]int{{1}, {2}, {3}, nil}},
+		{"ring", [][]int{{1}, {2}, {3}, {0}}},
+		{"star", [][]int{nil, {0}, {0}, {0}}},
+	} {
+		got, err := edges(r, tt.topology, 4, 3)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("edges(%s) = %v, %v; want %v", tt.topology, got, err, tt.want)
+		}
+	}
+
+	const n, degree = 50, 4
+	e, err := edges(r, "random", n, degree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for i, l := range e {
+		count += len(l)
+		for _, j := range l {
+			if j == i || j < 0 || j >= n {
+				t.Fatalf("node %d connects to %d", i, j)
+			}
+		}
+		if i > 0 && (len(l) == 0 || l[0] >= i) {
+			t.Errorf("node %d doesn't connect to an earlier node first: %v", i, l)
+		}
+	}
+	if max := n * degree / 2; count > max || count < n-1 {
+		t.Errorf("%d edges, want between %d and %d", count, n-1, max)
+	}
+
+	if _, err := edges(r, "torus", 4, 3); err == nil {
+		t.Error("edges(torus) succeeded, want an error")
+	}
+}
+
+func TestReportChurn(t *testing.T) {
+	s := &sim{
+		net:   transport.NewMemory(),
+		r:     rand.New(rand.NewSource(1)),
+		slots: make([]*peer.Node, 3),
+		sent:  make(map[string]*sent),
+	}
+	s.edges, _ = edges(s.r, "line", 3, 0)
+	for i := range s.slots {
+		s.start(i)
+	}
+	t.Cleanup(func() {
+		for _, n := range append(s.slots, s.retired...) {
+			n.Close()
+		}
+	})
+	// Nodes that aren't connected yet aren't expected to deliver it.
+	s.send(0, "unheard")
+
+	a, b := s.slots[1], s.slots[2]
+	s.sent["m"] = &sent{at: time.Now(), expected: map[*peer.Node]bool{a: true, b: true}}
+	s.deliver(a, peer.Message{ID: "m"})
+	s.deliver(a, peer.Message{ID: "m"})
+	s.replace(2) // b leaves before delivering the message.
+	s.deliver(s.slots[2], peer.Message{ID: "m"})
+	s.deliver(b, peer.Message{ID: "m"})
+
+	rep := s.report()
+	if rep.Messages != 2 || rep.Churn != 1 {
+		t.Errorf("Messages, Churn = %d, %d; want 2, 1", rep.Messages, rep.Churn)
+	}
+	if rep.Delivered != 1 || rep.Expected != 1 || rep.Ratio != 1 {
+		t.Errorf("delivered %d/%d (%v), want 1/1 (1)", rep.Delivered, rep.Expected, rep.Ratio)
+	}
+}
@@ -0,0 +1,80 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+// fakeMesh starts n fully connected gossiping nodes on an in-memory network
+// run by a fake clock, then adds latency and loss to the network.
+func fakeMesh(t *testing.T, n int) (*transport.Memory, *transport.FakeClock, []*Node, <-chan int) {
+	clock := transport.NewFakeClock()
+	net := transport.NewMemoryClock(clock)
+	nodes, delivered := startMesh(t, n, Config{
+		Mode:      Gossip,
+		Fanout:    3,
+		PushPull:  100 * time.Millisecond,
+		History:   16,
+		Transport: net,
+		Clock:     clock,
+	})
+	net.SetLatency(20 * time.Millisecond)
+	net.SetLoss(0.05, 1)
+	return net, clock, nodes, delivered
+}
+
+// await advances the clock of net in small steps, letting the nodes read
+// the packets that arrive at each and receiving from delivered between
+// them, until want nodes have delivered a message and recorded it in got.
+// It fails the test if a node for which bad returns true delivers one, or
+// if the nodes stop making progress.
+func await(t *testing.T, net *transport.Memory, clock *transport.FakeClock, delivered <-chan int, got map[int]bool, want int, bad func(int) bool) {
+	t.Helper()
+	const step = 10 * time.Millisecond
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < want {
+		select {
+		case i := <-delivered:
+			if bad != nil && bad(i) {
+				t.Fatalf("node %d delivered the message", i)
+			}
+			got[i] = true
+		default:
+			if time.Now().After(deadline) {
+				t.Fatalf("message delivered to %d nodes, want %d", len(got), want)
+			}
+			clock.Advance(step)
+			net.Settle()
+		}
+	}
+}
+
+func TestGossipFakeClock(t *testing.T) {
+	const n = 30
+	net, clock, nodes, delivered := fakeMesh(t, n)
+	nodes[0].Send("hello")
+	await(t, net, clock, delivered, make(map[int]bool), n-1, nil)
+}
+
+func TestGossipPartition(t *testing.T) {
+	const n = 20
+	net, clock, nodes, delivered := fakeMesh(t, n)
+	var a, b []string
+	for i, node := range nodes {
+		if i < n/2 {
+			a = append(a, node.Addr())
+		} else {
+			b = append(b, node.Addr())
+		}
+	}
+	net.Partition(a, b)
+	nodes[0].Send("hello")
+	got := make(map[int]bool)
+	acrossPartition := func(i int) bool { return i >= n/2 }
+	await(t, net, clock, delivered, got, n/2-1, acrossPartition)
+
+	net.Heal()
+	await(t, net, clock, delivered, got, n-1, nil)
+}
@@ -0,0 +1,1237 @@
+// Package peer implements a Whispering Gophers node: a program that accepts
+// connections from its peers, dials every peer it hears about, and relays the
+// messages it receives to the rest of the mesh.
+//
+// It is the code built in the code lab, generalised so that several nodes can
+// run in one process and their relaying strategy can be configured.
+package peer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// Message is the unit of communication between nodes.
+//
+// Chat messages have an empty Kind. Control messages exchanged between
+// neighbours set Kind to one of the Kind constants; they are never shown to
+// the user or relayed, and their Addr is always that of the sending node.
+type Message struct {
+	ID   string
+	Addr string
+	Body string
+	Kind string   `json:",omitempty"`
+	IDs  []string `json:",omitempty"`
+
+	// Nick is the nickname of the sender of a chat message.
+	Nick string `json:",omitempty"`
+
+	// From is the ID of the node that sent a chat message, which unlike
+	// Addr stays the same when the node restarts; see Config.ID.
+	From string `json:",omitempty"`
+
+	// Via lists the IDs of the nodes that relayed a chat message, in the
+	// order they did, up to maxVia of them.
+	Via []string `json:",omitempty"`
+
+	// Urgent marks a chat message that nodes send ahead of the chat
+	// messages already queued for each peer; see SendUrgent.
+	Urgent bool `json:",omitempty"`
+
+	// To is the address of the only node a direct chat message is for.
+	// Direct messages are sent straight to that node and never relayed.
+	To string `json:",omitempty"`
+
+	// Target, in a direct chat message sent with SendToID, is the ID of the
+	// node it is for; such messages are routed towards it by the nodes
+	// closest to it. In a find-node message, it is the ID whose closest
+	// nodes are wanted, and a nodes message repeats it.
+	Target string `json:",omitempty"`
+
+	// Codec is the wire format offered in a hello and accepted in a
+	// welcome.
+	Codec string `json:",omitempty"`
+
+	// Compress is the compression offered in a hello and accepted in a
+	// welcome.
+	Compress string `json:",omitempty"`
+
+	// Acks, in a hello or a welcome, offers or accepts acknowledgements
+	// of the chat messages sent on the connection.
+	Acks bool `json:",omitempty"`
+
+	// Pings, in a hello or a welcome, offers or agrees to answer pings on
+	// the connection.
+	Pings bool `json:",omitempty"`
+
+	// File, in a chat message, makes it a chunk of a shared file, whose
+	// data is in Body; see SendFile.
+	File *FileChunk `json:",omitempty"`
+
+	// Presence, in a chat message, makes it an announcement that Addr
+	// joined, is still in or is leaving the mesh; see Config.Keepalive.
+	Presence string `json:",omitempty"`
+
+	// Contacts, in a nodes message, lists the nodes the sender knows
+	// closest to Target.
+	Contacts []Contact `json:",omitempty"`
+
+	// Links, in a neighbours message, lists the connections of the node
+	// that sent it; see QueryTopology.
+	Links []Link `json:",omitempty"`
+
+	// Clock is the vector clock of a chat message: for each origin
+	// address, the number of messages from that origin the sender had
+	// seen when it sent this one, its own included.
+	Clock map[string]uint64 `json:",omitempty"`
+
+	// Nonce is the random challenge in a challenge or a hello on a
+	// network protected by Config.NetworkKey.
+	Nonce string `json:",omitempty"`
+
+	// MAC authenticates a message sent on a network protected by
+	// Config.NetworkKey; see sign.
+	MAC string `json:",omitempty"`
+}
+
+// Kinds of control messages.
+const (
+	KindHello      = "hello"      // first message on a connection, sent by the dialer
+	KindWelcome    = "welcome"    // the acceptor's answer to a hello offering a Codec or compression
+	KindChallenge  = "challenge"  // the acceptor's Nonce, sent first on a network with a key
+	KindAck        = "ack"        // the acceptor of a connection got the chat messages IDs
+	KindDigest     = "digest"     // IDs lists the messages recently seen by Addr
+	KindPull       = "pull"       // IDs lists the messages Addr wants to receive
+	KindIHave      = "ihave"      // IDs lists messages Addr can send on request
+	KindGraft      = "graft"      // Addr wants IDs and all future messages eagerly
+	KindPrune      = "prune"      // Addr wants only IHAVE announcements from now on
+	KindTopology   = "topology"   // Addr wants the acceptor's neighbours
+	KindNeighbours = "neighbours" // the answer to a topology message, with Links
+	KindPing       = "ping"       // the dialer of a connection wants a pong with the same ID
+	KindPong       = "pong"       // the acceptor's answer to a ping
+	KindFindNode   = "findnode"   // the dialer of a connection wants the nodes closest to Target
+	KindNodes      = "nodes"      // the acceptor's answer to a find-node message, with Contacts
+)
+
+// Mode selects how a Node relays the messages it receives.
+type Mode string
+
+const (
+	// Flood relays every message to every connected peer.
+	Flood Mode = "flood"
+	// Gossip relays every message to Fanout randomly chosen peers and relies
+	// on periodic push-pull rounds to reach the nodes that were missed.
+	Gossip Mode = "gossip"
+	// Plumtree relays every message along a spanning tree that is built by
+	// pruning the links that deliver duplicates. The remaining links only
+	// carry IHAVE announcements, and a GRAFT on one of them repairs the tree
+	// when a message announced there does not arrive through it in time.
+	Plumtree Mode = "plumtree"
+)
+
+// Defaults applied by New to the zero fields of Config.
+const (
+	defaultHistory      = 256
+	defaultGraftTimeout = 500 * time.Millisecond
+	defaultHoldTimeout  = 2 * time.Second
+	defaultPenalty      = time.Minute
+	defaultMaxFrame     = 64 << 10
+	defaultMaxBadFrames = 5
+	defaultPingInterval = 10 * time.Second
+)
+
+// Config holds the settings of a Node.
+// The zero value floods every message to every peer.
+type Config struct {
+	Mode Mode
+
+	// Fanout is the number of peers each message is relayed to in Gossip
+	// mode.
+	Fanout int
+
+	// PushPull is the interval between push-pull rounds in Gossip mode.
+	// In each round the node exchanges the IDs of its recent messages with
+	// a random peer and both sides fill in what the other is missing.
+	// Zero disables push-pull.
+	PushPull time.Duration
+
+	// History is the number of recent messages kept for push-pull rounds
+	// and GRAFT requests.
+	History int
+
+	// GraftTimeout is how long a node in Plumtree mode waits for a message
+	// announced by IHAVE before asking the announcer for it.
+	GraftTimeout time.Duration
+
+	// Causal holds back received messages until the messages their senders
+	// had seen before sending them have been delivered, so that replies
+	// are never shown before the messages they answer.
+	Causal bool
+
+	// HoldTimeout is how long a message is held back waiting for its causal
+	// predecessors before it is delivered anyway.
+	HoldTimeout time.Duration
+
+	// ConnRate is the number of messages per second accepted on each
+	// inbound connection, with bursts of up to ConnBurst messages.
+	// A peer that exceeds it is disconnected for Penalty. The messages a
+	// node asks a peer for, in push-pull rounds, pulls and grafts, count
+	// against neither this limit nor OriginRate.
+	// Zero means no limit.
+	ConnRate  float64
+	ConnBurst int
+
+	// OriginRate is the number of new chat messages, direct messages,
+	// shared files and announcements per second accepted from each
+	// originating address, with bursts of up to OriginBurst
+	// messages. Messages from an origin that exceeds it are dropped; the
+	// origin is disconnected for Penalty if it sent them itself, but the
+	// neighbours that relayed them are not, as they may just be passing on
+	// a noisy or forged origin.
+	// Zero means no limit.
+	OriginRate  float64
+	OriginBurst int
+
+	// Penalty is how long a peer that exceeds a rate limit stays
+	// disconnected.
+	Penalty time.Duration
+
+	// Codec is the wire format the node asks for on the connections it
+	// dials: CodecJSON (the default) or CodecBinary. The acceptor of a
+	// connection understands both, so the codec is chosen per connection.
+	Codec string
+
+	// Compress enables compression of the connections between nodes that
+	// both set it. The dialer of a connection compresses what it sends
+	// once the acceptor agrees.
+	Compress bool
+
+	// MaxFrame is the size in bytes of the largest message accepted from a
+	// peer. A peer that sends a larger one is disconnected for Penalty.
+	MaxFrame int
+
+	// MaxBadFrames is the number of malformed or invalid messages accepted
+	// on a connection before the peer is disconnected for Penalty.
+	MaxBadFrames int
+
+	// BanScore is the misbehaviour score at which a peer is banned for
+	// BanTime; see Ban. The default is 100 and a negative value disables
+	// automatic bans.
+	BanScore int
+	BanTime  time.Duration
+
+	// BanFile, if not empty, is the file in which the node keeps its ban
+	// list across restarts.
+	BanFile string
+
+	// PingInterval is the time between the pings that measure the
+	// round-trip time of the connections the node dials, reported by
+	// Peers.Info and used by Peers.Sample. The default is 10 seconds; a
+	// negative value disables pings.
+	PingInterval time.Duration
+
+	// DHTRefresh is the interval between the lookups that keep each
+	// bucket of the node's routing table filled; see SendToID. The
+	// default is 15 minutes; a negative value disables lookups, but the
+	// node still answers them and routes direct messages.
+	DHTRefresh time.Duration
+
+	// Transport is used to dial peers; it should be the one the node's
+	// listener came from. The default is transport.TCP.
+	Transport transport.Transport
+
+	// Clock times rate limits, penalties and the node's periodic work.
+	// The default is transport.RealClock; tests on a transport.Memory
+	// network may share its FakeClock.
+	Clock transport.Clock
+
+	// TLS, if not nil, secures every connection with mutual TLS; see
+	// NewTLSConfig. Such a node can only talk to peers that use TLS too.
+	TLS *tls.Config
+
+	// NetworkKey, if not nil, is a key shared by the nodes of a private
+	// network. Dialers prove they know it by signing their hello with a
+	// challenge from the acceptor, acceptors by signing their welcome with
+	// a nonce from the hello, and every message carries a MAC made with
+	// it. Messages and peers without a valid MAC are rejected, so
+	// networks with different keys can share a LAN without merging.
+	NetworkKey []byte
+
+	// Acks enables per-hop acknowledgements between nodes that both set
+	// it: the chat messages a node sends to a peer are sent again every
+	// AckTimeout, and after reconnecting, until the peer acknowledges
+	// them.
+	Acks       bool
+	AckTimeout time.Duration
+
+	// Downloads is the directory where the files shared by other nodes
+	// are written once complete. If empty, the node passes shared files on
+	// without keeping them.
+	Downloads string
+
+	// Downloaded, if not nil, is called for each file written to
+	// Downloads.
+	Downloaded func(Download)
+
+	// Keepalive is the interval between the announcements a node makes to
+	// tell the mesh it is still there. Zero disables its announcements;
+	// the node still keeps a roster of the others.
+	Keepalive time.Duration
+
+	// PresenceChanged, if not nil, is called with PresenceJoin when a node
+	// is added to the roster and with PresenceLeave when it announces
+	// that it's leaving.
+	PresenceChanged func(event string, m Member)
+
+	// ID identifies the node in the From field of its chat messages.
+	// If empty, New picks a random one; programs keep it across restarts
+	// with LoadID.
+	ID string
+
+	// Logger receives the node's logs. If nil, slog.Default is used.
+	Logger *slog.Logger
+
+	// NoDedup disables duplicate suppression, so that every copy of a
+	// message is delivered and relayed.
+	NoDedup bool
+
+	// NoDiscover stops the node from dialling the origins of the chat
+	// messages it receives, so that it only talks to the peers it dials
+	// and those that dial it, and the mesh keeps the shape it was given.
+	NoDiscover bool
+
+	// Deliver, if not nil, is called for every new chat message received.
+	Deliver func(Message)
+}
+
+// Stats counts the messages handled by a Node.
+type Stats struct {
+	Received      int64 // messages decoded from peers
+	Duplicates    int64 // chat messages dropped because they were already seen
+	Delivered     int64 // chat messages passed to Deliver
+	Held          int64 // chat messages held back for causal ordering
+	Expired       int64 // held messages delivered without their predecessors
+	Sent          int64 // messages queued to peers
+	Dropped       int64 // messages dropped because a peer's queue was full
+	Retransmitted int64 // unacknowledged messages sent again
+	Limited       int64 // messages dropped by rate limits
+	Penalties     int64 // peers disconnected for misbehaving
+	Banned        int64 // peers banned
+	Routed        int64 // direct messages passed on towards their recipient
+	BadFrames     int64 // messages rejected as oversized, malformed or invalid
+	BytesIn       int64 // bytes read from peer connections
+	BytesOut      int64 // bytes written to peer connections
+	RawIn         int64 // bytes of the messages read, before decompression
+	RawOut        int64 // bytes of the messages written, before compression
+}
+
+// Node is a member of the mesh.
+type Node struct {
+	cfg     Config
+	l       net.Listener
+	self    string
+	id      string
+	peers   *Peers
+	seen    *seenSet
+	history *history
+	tree    *tree
+	causal  *causal
+	files   *fileStore
+	roster  *roster
+	names   *names
+	limits  *limiter
+	bans    *banList
+	dht     *table
+	pins    *pins // nil unless peers are trusted on first use
+	stats   Stats
+	log     *slog.Logger
+
+	mu       sync.Mutex
+	nick     string
+	inbound  map[net.Conn]inConn // accepted connections from peers that said hello
+	outboxes map[string]*outbox  // unacknowledged messages by peer address
+	closed   bool
+	joined   int32 // set once the node has announced itself
+	clashed  int32 // set once another node was seen using this node's ID
+
+	bootstrapped int32 // set once the node has looked up its own ID
+}
+
+// New returns a Node that accepts connections on l.
+// Call Serve to start accepting them.
+func New(l net.Listener, cfg Config) *Node {
+	if cfg.Mode == "" {
+		cfg.Mode = Flood
+	}
+	if cfg.Mode == Plumtree {
+		if cfg.History == 0 {
+			cfg.History = defaultHistory
+		}
+		if cfg.GraftTimeout == 0 {
+			cfg.GraftTimeout = defaultGraftTimeout
+		}
+	}
+	if cfg.Causal && cfg.HoldTimeout == 0 {
+		cfg.HoldTimeout = defaultHoldTimeout
+	}
+	if cfg.Penalty == 0 {
+		cfg.Penalty = defaultPenalty
+	}
+	if cfg.Codec == "" {
+		cfg.Codec = CodecJSON
+	}
+	if cfg.MaxFrame == 0 {
+		cfg.MaxFrame = defaultMaxFrame
+	}
+	if cfg.MaxBadFrames == 0 {
+		cfg.MaxBadFrames = defaultMaxBadFrames
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.DHTRefresh == 0 {
+		cfg.DHTRefresh = defaultDHTRefresh
+	}
+	if cfg.BanScore == 0 {
+		cfg.BanScore = defaultBanScore
+	}
+	if cfg.BanTime == 0 {
+		cfg.BanTime = defaultBanTime
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = transport.TCP
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = transport.RealClock
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.ID == "" {
+		cfg.ID = util.RandomID()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	n := &Node{
+		cfg:     cfg,
+		id:      cfg.ID,
+		l:       l,
+		self:    l.Addr().String(),
+		peers:   NewPeers(),
+		seen:    newSeenSet(),
+		history: newHistory(cfg.History),
+		tree:    newTree(),
+		causal:  newCausal(),
+		files:   newFileStore(),
+		roster:  newRoster(),
+		names:   newNames(),
+		limits: newLimiter(cfg.Clock, Limits{
+			ConnRate:    cfg.ConnRate,
+			ConnBurst:   cfg.ConnBurst,
+			OriginRate:  cfg.OriginRate,
+			OriginBurst: cfg.OriginBurst,
+			Penalty:     cfg.Penalty,
+		}),
+		inbound:  make(map[net.Conn]inConn),
+		outboxes: make(map[string]*outbox),
+		bans:     newBanList(),
+		dht:      newTable(cfg.ID),
+		log:      cfg.Logger,
+	}
+	if p, ok := tofu.Load(cfg.TLS); ok {
+		n.pins = p.(*pins)
+	}
+	n.loadBans()
+	return n
+}
+
+// inConn describes a connection accepted from a peer.
+type inConn struct {
+	addr  string    // listen address of the peer
+	since time.Time // when it said hello
+}
+
+// logIn returns the logger for a connection accepted from addr.
+func (n *Node) logIn(addr string) *slog.Logger {
+	return n.log.With(util.LogDir, util.DirIn, util.LogPeer, addr)
+}
+
+// logOut returns the logger for a connection dialled to addr.
+func (n *Node) logOut(addr string) *slog.Logger {
+	return n.log.With(util.LogDir, util.DirOut, util.LogPeer, addr)
+}
+
+// Addr returns the listen address of the node.
+func (n *Node) Addr() string { return n.self }
+
+// Peers returns the registry of the node's outgoing connections.
+func (n *Node) Peers() *Peers { return n.peers }
+
+// History returns the recent chat messages remembered by the node, oldest
+// first. It is empty unless Config.History is set.
+func (n *Node) History() []Message { return n.history.Messages() }
+
+// Nick returns the nickname attached to the messages the node sends.
+func (n *Node) Nick() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nick
+}
+
+// ErrBadNick is returned by SetNick for nicknames peers would reject.
+var ErrBadNick = fmt.Errorf("nicknames must be printable and at most %d characters", maxNick)
+
+// SetNick sets the nickname attached to the messages the node sends.
+func (n *Node) SetNick(nick string) error {
+	if !validNick(nick) {
+		return ErrBadNick
+	}
+	n.mu.Lock()
+	n.nick = nick
+	n.mu.Unlock()
+	n.names.add(nick, n.id)
+	return nil
+}
+
+// Stats returns a snapshot of the node's counters.
+func (n *Node) Stats() Stats {
+	return Stats{
+		Received:      atomic.LoadInt64(&n.stats.Received),
+		Duplicates:    atomic.LoadInt64(&n.stats.Duplicates),
+		Delivered:     atomic.LoadInt64(&n.stats.Delivered),
+		Held:          atomic.LoadInt64(&n.stats.Held),
+		Expired:       atomic.LoadInt64(&n.stats.Expired),
+		Sent:          atomic.LoadInt64(&n.stats.Sent),
+		Dropped:       atomic.LoadInt64(&n.stats.Dropped),
+		Retransmitted: atomic.LoadInt64(&n.stats.Retransmitted),
+		Limited:       atomic.LoadInt64(&n.stats.Limited),
+		Penalties:     atomic.LoadInt64(&n.stats.Penalties),
+		Banned:        atomic.LoadInt64(&n.stats.Banned),
+		Routed:        atomic.LoadInt64(&n.stats.Routed),
+		BadFrames:     atomic.LoadInt64(&n.stats.BadFrames),
+		BytesIn:       atomic.LoadInt64(&n.stats.BytesIn),
+		BytesOut:      atomic.LoadInt64(&n.stats.BytesOut),
+		RawIn:         atomic.LoadInt64(&n.stats.RawIn),
+		RawOut:        atomic.LoadInt64(&n.stats.RawOut),
+	}
+}
+
+// Serve accepts connections from peers and handles the messages they send.
+// It returns when the listener fails.
+func (n *Node) Serve() error {
+	if n.cfg.Mode == Gossip && n.cfg.PushPull > 0 {
+		go n.pushPull()
+	}
+	if n.cfg.Causal {
+		go n.expireLoop()
+	}
+	if n.cfg.Keepalive > 0 {
+		go n.keepalive()
+	}
+	if n.cfg.DHTRefresh > 0 {
+		go n.refresh()
+	}
+	for {
+		c, err := n.l.Accept()
+		if err != nil {
+			return err
+		}
+		go n.serve(c)
+	}
+}
+
+func (n *Node) serve(c net.Conn) {
+	lg := n.logIn(c.RemoteAddr().String())
+	lg.Info("accepted connection")
+	if n.cfg.TLS != nil {
+		tc, err := n.secure(c, false)
+		if err != nil {
+			lg.Warn("handshake failed", util.LogErr, err)
+			c.Close()
+			return
+		}
+		c = tc
+		lg.Info("authenticated", "name", peerName(c))
+	}
+	var challenge string
+	if n.cfg.NetworkKey != nil {
+		challenge = newNonce()
+		c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		err := json.NewEncoder(c).Encode(Message{Kind: KindChallenge, Addr: n.self, Nonce: challenge})
+		if err != nil {
+			lg.Warn("connection failed", util.LogErr, err)
+			c.Close()
+			return
+		}
+	}
+	d := newFrameDecoder(countReader{c, &n.stats.BytesIn}, n.cfg.MaxFrame)
+	d.raw = &n.stats.RawIn
+	var from string // listen address of the peer, if it said hello
+	var rate bucket
+	var acks *acker // nil unless the peer wants acknowledgements
+	var ids recent  // to spot repeated messages
+	bad := 0
+	for {
+		var m Message
+		err := d.Decode(&m)
+		if err == nil {
+			err = m.validate()
+		}
+		if err == errFrameTooLarge {
+			atomic.AddInt64(&n.stats.BadFrames, 1)
+			lg.Warn("bad message", util.LogErr, err)
+			n.penalise(from, "sent an oversized message")
+			break
+		}
+		if err != nil && recoverable(err) {
+			atomic.AddInt64(&n.stats.BadFrames, 1)
+			lg.Warn("bad message", util.LogErr, err)
+			n.misbehaved(from, scoreBadMessage, "sent bad messages")
+			if bad++; bad >= n.cfg.MaxBadFrames {
+				n.penalise(from, "sent too many bad messages")
+				break
+			}
+			continue
+		}
+		if err != nil {
+			lg.Info("connection failed", util.LogErr, err)
+			break
+		}
+		if n.cfg.NetworkKey != nil && !n.admit(&m, from, challenge) {
+			atomic.AddInt64(&n.stats.BadFrames, 1)
+			lg.Warn("bad message", util.LogErr, errWrongKey)
+			n.penalise(from, "sent a message without a valid MAC")
+			break
+		}
+		atomic.AddInt64(&n.stats.Received, 1)
+		if lim := n.limits.get(); !(m.Kind == "" && n.limits.granted(from, false)) && !rate.take(lim.ConnRate, lim.ConnBurst, n.cfg.Clock.Now()) {
+			atomic.AddInt64(&n.stats.Limited, 1)
+			if from == "" {
+				lg.Warn("exceeded connection rate limit")
+			}
+			n.penalise(from, "exceeded connection rate limit")
+			break
+		}
+		if m.Kind == KindTopology {
+			if err := json.NewEncoder(c).Encode(n.neighbours()); err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				break
+			}
+			continue
+		}
+		if m.Kind == KindHello {
+			from = m.Addr
+			lg = lg.With("node", from)
+			if n.limits.penalised(from) {
+				lg.Info("refused: serving a penalty")
+				break
+			}
+			if err := n.checkPin(c, m.From); err != nil {
+				lg.Warn("refused: untrusted certificate", util.LogErr, err)
+				break
+			}
+			n.mu.Lock()
+			n.inbound[c] = inConn{addr: from, since: n.cfg.Clock.Now()}
+			n.mu.Unlock()
+			n.learn(Contact{ID: m.From, Addr: from})
+			if n.cfg.NetworkKey != nil {
+				c.SetReadDeadline(time.Time{})
+			}
+			if m.Codec != "" || m.Compress != "" || m.Acks || m.Pings || m.From != "" || n.cfg.NetworkKey != nil {
+				// The dialer offers a codec, compression,
+				// acknowledgements or pings, or tells its ID;
+				// accept what we can and tell ours.
+				w := Message{Kind: KindWelcome, Addr: n.self, From: n.id, Codec: m.Codec, Pings: m.Pings}
+				if n.cfg.Compress && m.Compress == CompressFlate {
+					w.Compress = CompressFlate
+				}
+				if n.cfg.Acks && m.Acks {
+					w.Acks = true
+					acks = &acker{}
+				}
+				if n.cfg.NetworkKey != nil {
+					w.MAC = n.sign(w, m.Nonce)
+				}
+				if err := json.NewEncoder(c).Encode(w); err != nil {
+					lg.Info("connection failed", util.LogErr, err)
+					break
+				}
+			}
+		}
+		if m.Kind == KindPing || m.Kind == KindFindNode {
+			reply := Message{Kind: KindPong, Addr: n.self, ID: m.ID}
+			if m.Kind == KindFindNode {
+				reply = n.nodes(m)
+			}
+			if n.cfg.NetworkKey != nil {
+				reply.MAC = n.sign(reply, "")
+			}
+			if err := json.NewEncoder(c).Encode(reply); err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				break
+			}
+			continue
+		}
+		if m.Kind == "" && ids.repeat(m.ID) && acks == nil {
+			// A peer that wants acks sends again what it hasn't
+			// seen acknowledged yet; such repeats are acknowledged
+			// again below, not held against it.
+			n.misbehaved(from, scoreRepeat, "repeated messages")
+		}
+		n.receive(m, from)
+		if acks != nil && (acks.add(m) || !d.more()) {
+			// Acknowledge what was read once there is nothing more
+			// to read right away.
+			if ack, ok := acks.take(n.self); ok {
+				if n.cfg.NetworkKey != nil {
+					ack.MAC = n.sign(ack, "")
+				}
+				if err := json.NewEncoder(c).Encode(ack); err != nil {
+					lg.Info("connection failed", util.LogErr, err)
+					break
+				}
+			}
+		}
+	}
+	n.mu.Lock()
+	delete(n.inbound, c)
+	n.mu.Unlock()
+	c.Close()
+	lg.Info("closed")
+}
+
+// receive handles a message decoded from a peer connection.
+// From is the listen address of the peer that sent it, if known.
+func (n *Node) receive(m Message, from string) {
+	if m.Kind != "" || !n.cfg.NoDiscover {
+		go n.Dial(m.Addr)
+	}
+	switch m.Kind {
+	case "":
+	case KindHello, KindWelcome, KindAck, KindTopology, KindNeighbours, KindFindNode, KindNodes:
+		return
+	case KindDigest, KindPull, KindIHave, KindGraft, KindPrune:
+		if from == "" || m.Addr != from {
+			// Acting on it would send messages to, or change the
+			// links of, a node that didn't ask for it.
+			n.log.Debug("dropped control message from another address", util.LogPeer, from, util.LogOrigin, m.Addr, "kind", m.Kind)
+			return
+		}
+		switch m.Kind {
+		case KindDigest:
+			n.handleDigest(m, from)
+		case KindPull:
+			n.handlePull(m, from)
+		case KindIHave:
+			n.handleIHave(m, from)
+		case KindGraft:
+			n.handleGraft(m, from)
+		case KindPrune:
+			n.handlePrune(from)
+		}
+		return
+	default:
+		n.log.Warn("unknown message kind", util.LogPeer, from, util.LogOrigin, m.Addr, "kind", m.Kind)
+		return
+	}
+	if m.Target != "" {
+		n.receiveRouted(m, from)
+		return
+	}
+	if m.To != "" {
+		n.receiveDirect(m, from)
+		return
+	}
+	if m.File != nil {
+		n.receiveChunk(m, from)
+		return
+	}
+	if m.Presence != "" {
+		n.receivePresence(m, from)
+		return
+	}
+	duplicate := func() {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		if n.cfg.Mode == Plumtree {
+			n.prune(from)
+		}
+	}
+	if n.seen.Has(m.ID) {
+		duplicate()
+		return
+	}
+	if !n.withinLimits(m, from) {
+		return
+	}
+	if n.Seen(m.ID) {
+		duplicate() // Another copy got in first.
+		return
+	}
+	n.learnName(m)
+	n.log.Debug("received", util.LogPeer, from, util.LogOrigin, m.Addr, util.LogID, m.ID, "via", m.Via, "text", n.Format(m))
+	n.see(m)
+	n.deliver(m)
+	m = n.hop(m)
+	n.history.Add(m)
+	if n.cfg.Mode == Plumtree {
+		n.tree.arrived(m.ID, from)
+	}
+	n.relay(m, from)
+}
+
+// hop returns m as relayed by the node: with the node's ID added to Via,
+// unless Via is full.
+func (n *Node) hop(m Message) Message {
+	if len(m.Via) < maxVia {
+		m.Via = append(m.Via[:len(m.Via):len(m.Via)], n.id)
+	}
+	return m
+}
+
+// receiveDirect delivers a direct message addressed to this node.
+func (n *Node) receiveDirect(m Message, from string) {
+	if m.To != n.self {
+		n.log.Debug("dropped direct message for another node", util.LogOrigin, m.Addr, util.LogID, m.ID, "to", m.To)
+		return
+	}
+	if n.seen.Has(m.ID) {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		return
+	}
+	if !n.withinLimits(m, from) {
+		return
+	}
+	if n.Seen(m.ID) {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		return
+	}
+	n.learnName(m)
+	n.log.Debug("received direct message", util.LogOrigin, m.Addr, util.LogID, m.ID, "text", n.Format(m))
+	n.see(m)
+	n.show(m)
+}
+
+// Send originates a chat message with the given body and returns it.
+func (n *Node) Send(body string) Message { return n.originate(body, false) }
+
+// SendUrgent is like Send, but the message is marked Urgent, so that every
+// node sends it ahead of the chat messages already queued.
+func (n *Node) SendUrgent(body string) Message { return n.originate(body, true) }
+
+// originate sends a new chat message with the given body to the mesh and
+// returns it.
+func (n *Node) originate(body string, urgent bool) Message {
+	m := Message{
+		ID:     util.RandomID(),
+		Addr:   n.self,
+		Body:   body,
+		Nick:   n.Nick(),
+		From:   n.id,
+		Urgent: urgent,
+	}
+	if n.cfg.Causal {
+		m.Clock = n.causal.stamp(n.self)
+	}
+	n.Seen(m.ID)
+	n.history.Add(m)
+	n.relay(m, "")
+	return m
+}
+
+// relay passes a chat message received from the given peer on to the node's
+// other peers according to its Mode.
+func (n *Node) relay(m Message, from string) {
+	var l []*peerConn
+	switch n.cfg.Mode {
+	case Gossip:
+		l = n.peers.sample(n.cfg.Fanout)
+	case Plumtree:
+		n.pushTree(m, from)
+		return
+	default:
+		l = n.peers.list()
+	}
+	for _, pc := range l {
+		n.send(pc, m)
+	}
+}
+
+// ErrNotConnected is returned by SendTo when there is no connection to the
+// recipient.
+var ErrNotConnected = errors.New("peer not connected")
+
+// SendTo sends a direct message with the given body to the peer at addr,
+// which must be connected, and returns it.
+func (n *Node) SendTo(addr, body string) (Message, error) {
+	m := Message{
+		ID:   util.RandomID(),
+		Addr: n.self,
+		Body: body,
+		Nick: n.Nick(),
+		From: n.id,
+		To:   addr,
+	}
+	pc := n.peers.get(addr)
+	if pc == nil {
+		return m, ErrNotConnected
+	}
+	n.send(pc, m)
+	return m, nil
+}
+
+// send queues m for the peer pc according to its priority. Chat messages are
+// dropped if their queue is full; control messages never are.
+func (n *Node) send(pc *peerConn, m Message) {
+	if pc.push(m) {
+		atomic.AddInt64(&n.stats.Sent, 1)
+		return
+	}
+	// Okay to drop chat messages sometimes: a peer that acknowledges
+	// them gets them again later.
+	atomic.AddInt64(&n.stats.Dropped, 1)
+	if o := n.unackedBy(pc.addr); o != nil && needsAck(m) {
+		o.add(m, time.Time{})
+	}
+}
+
+// Dial connects to the peer at addr and sends it the messages queued for it
+// until the connection fails. It does nothing if addr is the node itself or
+// a peer that is already connected.
+func (n *Node) Dial(addr string) {
+	if pc := n.register(addr); pc != nil {
+		n.dial(addr, pc)
+	}
+}
+
+// open returns the registry entry of the peer at addr, dialling the peer in
+// the background if it isn't registered, or nil if the node won't dial it.
+func (n *Node) open(addr string) *peerConn {
+	pc := n.register(addr)
+	if pc == nil {
+		return n.peers.get(addr)
+	}
+	go n.dial(addr, pc)
+	return pc
+}
+
+// register adds the peer at addr to the registry and returns its entry,
+// unless it is the node itself, a peer serving a penalty or one that is
+// already registered, or the node is closed.
+func (n *Node) register(addr string) *peerConn {
+	if addr == "" || addr == n.self {
+		return nil // Don't try to dial self.
+	}
+	if n.limits.penalised(addr) || n.isClosed() {
+		return nil
+	}
+	return n.peers.add(addr)
+}
+
+// dial connects to the peer at addr, registered as pc, and sends it the
+// messages queued for it until the connection fails.
+func (n *Node) dial(addr string, pc *peerConn) {
+	defer n.peers.Remove(addr)
+	defer n.tree.forget(addr)
+
+	lg := n.logOut(addr)
+	lg.Debug("dialling")
+	c, err := n.cfg.Transport.Dial(addr)
+	if err != nil {
+		lg.Info("dial failed", util.LogErr, err)
+		n.dht.remove(addr)
+		n.dropOutbox(addr)
+		return
+	}
+	if n.cfg.TLS != nil {
+		tc, err := n.secure(c, true)
+		if err != nil {
+			lg.Warn("handshake failed", util.LogErr, err)
+			c.Close()
+			return
+		}
+		c = tc
+		lg.Info("authenticated", "name", peerName(c))
+	}
+	lg.Info("connected")
+	n.peers.setConnected(addr)
+	n.join()
+	defer func() {
+		c.Close()
+		lg.Info("closed")
+	}()
+
+	e := newOutStream(c, &n.stats.BytesOut, &n.stats.RawOut)
+	hello := Message{Kind: KindHello, Addr: n.self, From: n.id}
+	if n.cfg.Codec != CodecJSON {
+		hello.Codec = n.cfg.Codec
+	}
+	if n.cfg.Compress {
+		hello.Compress = CompressFlate
+	}
+	hello.Acks = n.cfg.Acks
+	hello.Pings = n.cfg.PingInterval > 0
+	// write sends m; the caller flushes.
+	write := func(m Message) error {
+		if n.cfg.NetworkKey != nil {
+			m.MAC = n.sign(m, "")
+		}
+		return e.Encode(m)
+	}
+	// The acceptor acknowledges chat messages once out is set; retry
+	// fires when it's time to send the unacknowledged ones again.
+	var out *outbox
+	retry := make(chan struct{}, 1)
+	timer := n.cfg.Clock.AfterFunc(n.cfg.AckTimeout, func() {
+		select {
+		case retry <- struct{}{}:
+		default:
+		}
+	})
+	defer timer.Stop()
+	// Once the acceptor agrees to answer pings, pingc fires when it's
+	// time to send the next one.
+	var ping Message
+	var pinged time.Time
+	var pinger transport.Timer
+	pingc := make(chan struct{}, 1)
+	firePing := func() {
+		select {
+		case pingc <- struct{}{}:
+		default:
+		}
+	}
+	defer func() {
+		if pinger != nil {
+			pinger.Stop()
+		}
+	}()
+	resend := func(by time.Time) error {
+		l := out.due(by, n.cfg.Clock.Now())
+		for _, m := range l {
+			if err := write(m); err != nil {
+				return err
+			}
+		}
+		if len(l) == 0 {
+			return nil
+		}
+		atomic.AddInt64(&n.stats.Retransmitted, int64(len(l)))
+		lg.Debug("retransmitted unacknowledged messages", "count", len(l))
+		return e.Flush()
+	}
+	welcome := func(m Message) error {
+		n.learn(Contact{ID: m.From, Addr: addr})
+		if m.Acks && n.cfg.Acks && out == nil {
+			// Send again what the peer missed on earlier
+			// connections.
+			out = n.outbox(addr)
+			if err := resend(n.cfg.Clock.Now()); err != nil {
+				return err
+			}
+		}
+		if m.Pings && n.cfg.PingInterval > 0 && pinger == nil {
+			pinger = n.cfg.Clock.AfterFunc(n.cfg.PingInterval, firePing)
+			firePing() // Ping right away.
+		}
+		if m.Codec != "" {
+			lg.Debug("switching codec", "codec", m.Codec)
+			e.setCodec(m.Codec)
+		}
+		if m.Compress == CompressFlate && n.cfg.Compress {
+			lg.Debug("compressing")
+			return e.compress()
+		}
+		return nil
+	}
+	// sendQueued sends l, messages taken from the peer's queues, and
+	// flushes unless more are waiting.
+	sendQueued := func(l []Message) error {
+		for _, m := range l {
+			if err := write(m); err != nil {
+				return err
+			}
+			if out != nil && needsAck(m) && out.add(m, n.cfg.Clock.Now()) {
+				lg.Warn("too many unacknowledged messages; dropped the oldest")
+			}
+		}
+		if len(l) == 0 || len(pc.ch) > 0 {
+			return nil
+		}
+		return e.Flush()
+	}
+	d := newFrameDecoder(c, n.cfg.MaxFrame)
+	var w Message
+	switch {
+	case n.cfg.NetworkKey != nil:
+		w, err = n.proveKey(c, d, e, hello)
+	case n.pins != nil:
+		// Nothing else is sent before the certificate of the peer is
+		// checked against the ID in its welcome.
+		w, err = n.awaitWelcome(c, d, e, hello)
+	default:
+		err = e.Encode(hello)
+	}
+	if err != nil {
+		lg.Info("connection failed", util.LogErr, err)
+		return
+	}
+	if w.Kind == KindWelcome {
+		if err := n.checkPin(c, w.From); err != nil {
+			lg.Warn("untrusted certificate", util.LogErr, err)
+			return
+		}
+		if err := welcome(w); err != nil {
+			lg.Info("connection failed", util.LogErr, err)
+			return
+		}
+	}
+	replies, done := make(chan Message), make(chan struct{})
+	defer close(done)
+	go n.readReplies(d, replies, done)
+	for {
+		select {
+		case <-pc.ready:
+			if err := sendQueued(pc.take()); err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				return
+			}
+		case m := <-pc.ch:
+			// Control and urgent messages go first.
+			if err := sendQueued(append(pc.take(), m)); err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				return
+			}
+		case m := <-replies:
+			var err error
+			switch {
+			case m.Kind == KindWelcome:
+				err = welcome(m)
+			case m.Kind == KindAck && out != nil:
+				if n.cfg.NetworkKey != nil && !n.verify(m, "") {
+					err = errWrongKey
+					break
+				}
+				out.ack(m.IDs)
+			case m.Kind == KindNodes:
+				if n.cfg.NetworkKey != nil && !n.verify(m, "") {
+					err = errWrongKey
+					break
+				}
+				n.found(m)
+			case m.Kind == KindPong && m.ID == ping.ID && ping.ID != "":
+				if n.cfg.NetworkKey != nil && !n.verify(m, "") {
+					err = errWrongKey
+					break
+				}
+				rtt := n.cfg.Clock.Now().Sub(pinged)
+				n.peers.setRTT(addr, rtt)
+				lg.Debug("pong", "rtt", rtt)
+				ping.ID = ""
+			}
+			if err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				return
+			}
+		case <-pingc:
+			pinger.Reset(n.cfg.PingInterval)
+			ping = Message{Kind: KindPing, Addr: n.self, ID: util.RandomID()}
+			pinged = n.cfg.Clock.Now()
+			err := write(ping)
+			if err == nil {
+				err = e.Flush()
+			}
+			if err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				return
+			}
+		case <-retry:
+			timer.Reset(n.cfg.AckTimeout)
+			if out == nil {
+				break
+			}
+			if err := resend(n.cfg.Clock.Now().Add(-n.cfg.AckTimeout)); err != nil {
+				lg.Info("connection failed", util.LogErr, err)
+				return
+			}
+		case <-pc.quit:
+			return
+		}
+	}
+}
+
+// readReplies reads the messages sent back by the acceptor of a connection
+// dialled by the node, and passes them to the dialling goroutine until done
+// is closed. Acceptors that are code lab programs never reply.
+func (n *Node) readReplies(d *frameDecoder, replies chan<- Message, done <-chan struct{}) {
+	for {
+		var m Message
+		if err := decodeValid(d, &m); err != nil {
+			return // The dialling goroutine reports errors.
+		}
+		select {
+		case replies <- m:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Disconnect closes the connections to and from the peer at addr.
+// The peer is dialled again if the node hears from it later.
+// It reports whether there was any connection to close.
+func (n *Node) Disconnect(addr string) bool {
+	ok := n.peers.hangUp(addr)
+	n.mu.Lock()
+	for c, in := range n.inbound {
+		if in.addr == addr {
+			c.Close()
+			ok = true
+		}
+	}
+	n.mu.Unlock()
+	return ok
+}
+
+// Close stops the node: it announces that it's leaving, if it announced
+// itself, closes its listener, which makes Serve return, and its connections
+// to and from peers, and dials no more.
+func (n *Node) Close() error {
+	n.leave()
+	n.mu.Lock()
+	n.closed = true
+	for c := range n.inbound {
+		c.Close()
+	}
+	n.mu.Unlock()
+	err := n.l.Close()
+	for _, addr := range n.peers.Addrs() {
+		n.peers.hangUp(addr)
+	}
+	return err
+}
+
+func (n *Node) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+// Seen returns true if the specified id has been seen before.
+// If not, it returns false and marks the given id as "seen".
+func (n *Node) Seen(id string) bool {
+	if n.cfg.NoDedup || id == "" {
+		return false
+	}
+	return n.seen.Seen(id)
+}
@@ -0,0 +1,334 @@
+package peer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+// startMesh starts n fully connected nodes on loopback addresses, or on
+// cfg.Transport if set. Each node's deliveries are sent on the returned
+// channel, tagged with the node index.
+func startMesh(t *testing.T, n int, cfg Config) ([]*Node, <-chan int) {
+	delivered := make(chan int, 100*n)
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		var l net.Listener
+		var err error
+		c, i := cfg, i
+		if m, ok := cfg.Transport.(*transport.Memory); ok {
+			// Give each node a host of its own, for partitions.
+			h := m.Host()
+			c.Transport = h
+			l, err = h.Listen()
+		} else if cfg.Transport != nil {
+			l, err = cfg.Transport.Listen()
+		} else {
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		c.Deliver = func(Message) { delivered <- i }
+		nodes[i] = New(l, c)
+		go nodes[i].Serve()
+	}
+	for _, a := range nodes {
+		for _, b := range nodes {
+			go a.Dial(b.Addr())
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, a := range nodes {
+		for a.Peers().Len() < n-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v connected to %d peers, want %d", a.Addr(), a.Peers().Len(), n-1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nodes, delivered
+}
+
+// waitDelivered waits until every node but the first has delivered a message.
+func waitDelivered(t *testing.T, n int, delivered <-chan int, timeout time.Duration) {
+	got := make(map[int]bool)
+	deadline := time.After(timeout)
+	for len(got) < n-1 {
+		select {
+		case i := <-delivered:
+			got[i] = true
+		case <-deadline:
+			t.Fatalf("message delivered to %d nodes, want %d", len(got), n-1)
+		}
+	}
+}
+
+func TestFlood(t *testing.T) {
+	const n = 5
+	nodes, delivered := startMesh(t, n, Config{})
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+}
+
+func TestGossipPushPull(t *testing.T) {
+	const n = 8
+	nodes, delivered := startMesh(t, n, Config{
+		Mode:     Gossip,
+		Fanout:   1,
+		PushPull: 20 * time.Millisecond,
+		History:  16,
+	})
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+	if s := nodes[0].Stats(); s.Sent == 0 {
+		t.Errorf("node sent no messages")
+	}
+}
+
+func TestControlFromAnotherAddress(t *testing.T) {
+	n := newTestNode(t, Config{Mode: Gossip, History: 16})
+	m := n.Send("hello")
+	// Nobody listens at these.
+	const victim, sender = "127.0.0.1:1", "127.0.0.1:2"
+	to, back := n.peers.add(victim), n.peers.add(sender)
+	n.receive(Message{Kind: KindDigest, Addr: victim}, sender)
+	n.receive(Message{Kind: KindPull, Addr: victim, IDs: []string{m.ID}}, sender)
+	if q := to.queued() + back.queued(); q != 0 {
+		t.Errorf("answered control messages claiming another address with %d messages", q)
+	}
+	n.receive(Message{Kind: KindPull, Addr: sender, IDs: []string{m.ID}}, sender)
+	if q := back.queued(); q != 1 {
+		t.Errorf("answered a pull with %d messages, want 1", q)
+	}
+}
+
+func TestPlumtreeControlFromAnotherAddress(t *testing.T) {
+	n := newTestNode(t, Config{Mode: Plumtree, GraftTimeout: time.Hour})
+	m := n.Send("hello")
+	// Nobody listens at these.
+	const victim, sender = "127.0.0.1:1", "127.0.0.1:2"
+	to := n.peers.add(victim)
+	n.peers.add(sender)
+	n.receive(Message{Kind: KindPrune, Addr: victim}, sender)
+	if n.tree.isLazy(victim) {
+		t.Error("pruned the link to a node that didn't ask for it")
+	}
+	n.tree.setLazy(victim, true)
+	n.receive(Message{Kind: KindGraft, Addr: victim, IDs: []string{m.ID}}, sender)
+	if !n.tree.isLazy(victim) || to.queued() != 0 {
+		t.Error("grafted the link to a node that didn't ask for it")
+	}
+	n.receive(Message{Kind: KindIHave, Addr: victim, IDs: []string{"0123456789abcdef"}}, sender)
+	if len(n.tree.missing) != 0 {
+		t.Error("waiting for a message announced under another address")
+	}
+
+	n.receive(Message{Kind: KindPrune, Addr: sender}, sender)
+	if !n.tree.isLazy(sender) {
+		t.Error("prune not applied to its sender")
+	}
+}
+
+func TestPlumtreePrunes(t *testing.T) {
+	const n, msgs = 6, 5
+	nodes, delivered := startMesh(t, n, Config{Mode: Plumtree})
+	nodes[0].Send("warm up")
+	waitDelivered(t, n, delivered, 5*time.Second)
+	time.Sleep(100 * time.Millisecond) // let the prunes arrive
+
+	before := totalDuplicates(nodes)
+	for i := 0; i < msgs; i++ {
+		nodes[0].Send("hello")
+		waitDelivered(t, n, delivered, 5*time.Second)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Flooding delivers each message n-1 times to every node but the
+	// sender, and n-2 times to the sender.
+	flood := int64(msgs * (n - 1) * (n - 2))
+	if dups := totalDuplicates(nodes) - before; dups >= flood/2 {
+		t.Errorf("%d duplicates after the tree formed, want fewer than %d", dups, flood/2)
+	}
+}
+
+func TestPlumtreeGraft(t *testing.T) {
+	const n = 4
+	nodes, delivered := startMesh(t, n, Config{
+		Mode:         Plumtree,
+		GraftTimeout: 20 * time.Millisecond,
+	})
+	// Break every tree link out of the sender; the others must graft.
+	for _, addr := range nodes[0].Peers().Addrs() {
+		nodes[0].tree.setLazy(addr, true)
+	}
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+}
+
+func totalDuplicates(nodes []*Node) int64 {
+	var d int64
+	for _, n := range nodes {
+		d += n.Stats().Duplicates
+	}
+	return d
+}
+
+func TestPeersSample(t *testing.T) {
+	p := NewPeers()
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		if p.Add(addr) == nil {
+			t.Fatalf("Add(%q) returned nil, want channel", addr)
+		}
+	}
+	if l := p.Sample(2); len(l) != 2 {
+		t.Errorf("Sample(2) returned %d peers, want 2", len(l))
+	}
+	if l := p.Sample(10); len(l) != 4 {
+		t.Errorf("Sample(10) returned %d peers, want 4", len(l))
+	}
+	seen := make(map[chan<- Message]bool)
+	for _, ch := range p.Sample(4) {
+		if seen[ch] {
+			t.Fatal("Sample returned the same peer twice")
+		}
+		seen[ch] = true
+	}
+}
+
+func TestPeersSampleLatency(t *testing.T) {
+	p := NewPeers()
+	p.Add("near")
+	p.Add("far")
+	p.setRTT("near", 10*time.Millisecond)
+	p.setRTT("far", 90*time.Millisecond)
+	near := 0
+	for i := 0; i < 1000; i++ {
+		if p.sample(1)[0].addr == "near" {
+			near++
+		}
+	}
+	// The near peer should be chosen 90% of the time.
+	if near < 800 {
+		t.Errorf("near peer chosen %d times out of 1000, want about 900", near)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	p := NewPeers()
+	p.Add("a")
+	pc := p.get("a")
+	for i := 0; i < queueLen; i++ {
+		if !pc.push(Message{Body: "chat"}) || !pc.push(Message{Body: "urgent", Urgent: true}) {
+			t.Fatalf("push %d failed, want room for %d messages", i, queueLen)
+		}
+	}
+	if pc.push(Message{Body: "chat"}) || pc.push(Message{Body: "urgent", Urgent: true}) {
+		t.Error("push to a full queue succeeded")
+	}
+	if pc.push(Message{Presence: PresenceAlive}) {
+		t.Error("push of an announcement to a full chat queue succeeded")
+	}
+	for i := 0; i < maxControl-1; i++ {
+		m := Message{Kind: KindIHave}
+		if i%2 == 1 {
+			m = Message{Kind: KindGraft}
+		}
+		if !pc.push(m) {
+			t.Fatalf("%+v dropped", m)
+		}
+	}
+	if i := p.Info()[0]; i.Queued != 2*queueLen+maxControl-1 {
+		t.Errorf("Queued = %d, want %d", i.Queued, 2*queueLen+maxControl-1)
+	}
+	l := pc.take()
+	if len(l) != queueLen+maxControl-1 || l[0].Kind != KindIHave || l[len(l)-1].Body != "urgent" {
+		t.Errorf("take returned %d messages, want the %d control messages, then the %d urgent ones", len(l), maxControl-1, queueLen)
+	}
+	for i := 0; i < maxControl; i++ {
+		pc.push(Message{Kind: KindIHave})
+	}
+	select {
+	case <-pc.quit:
+	default:
+		t.Error("a peer with too many control messages queued wasn't hung up on")
+	}
+}
+
+func TestRTT(t *testing.T) {
+	p := NewPeers()
+	p.Add("a")
+	for _, rtt := range []time.Duration{80, 80, 160} {
+		p.setRTT("a", rtt*time.Millisecond)
+	}
+	// The first round trip sets RTT to 80ms and the jitter to 40ms, and
+	// the second cuts the jitter to 30ms. The third moves RTT 1/8 of the
+	// way to 160ms, and the jitter 1/4 of the way to the 80ms deviation.
+	i := p.Info()[0]
+	if i.RTT != 90*time.Millisecond || i.Jitter != 42500*time.Microsecond {
+		t.Errorf("RTT, Jitter = %v, %v; want 90ms, 42.5ms", i.RTT, i.Jitter)
+	}
+}
+
+func TestPing(t *testing.T) {
+	nodes, _ := startMesh(t, 2, Config{PingInterval: 20 * time.Millisecond})
+	waitFor(t, 5*time.Second, "a round-trip time", func() bool {
+		l := nodes[0].Peers().Info()
+		return len(l) == 1 && l[0].RTT > 0
+	})
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(2)
+	for _, id := range []string{"a", "b", "c"} {
+		h.Add(Message{ID: id})
+	}
+	if _, ok := h.Get("a"); ok {
+		t.Error(`history still has "a", want it evicted`)
+	}
+	if got := h.IDs(); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Errorf("IDs() = %v, want [b c]", got)
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	const n = 4
+	nodes, delivered := startMesh(t, n, Config{Transport: transport.NewMemory(), Compress: true})
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+}
+
+func TestVia(t *testing.T) {
+	got := make(chan Message, 1)
+	var nodes []*Node
+	for i := 0; i < 3; i++ {
+		cfg := Config{NoDiscover: true}
+		if i == 2 {
+			cfg.Deliver = func(m Message) { got <- m }
+		}
+		nodes = append(nodes, newTestNode(t, cfg))
+	}
+	// A line: 0 - 1 - 2. Each node dials back the peers that dial it.
+	go nodes[0].Dial(nodes[1].Addr())
+	go nodes[1].Dial(nodes[2].Addr())
+	waitFor(t, 5*time.Second, "the line to connect", func() bool {
+		return nodes[0].Peers().Len() == 1 && nodes[1].Peers().Len() == 2 && nodes[2].Peers().Len() == 1
+	})
+	nodes[0].Send("hello")
+	select {
+	case m := <-got:
+		if want := []string{nodes[1].ID()}; !reflect.DeepEqual(m.Via, want) {
+			t.Errorf("Via = %v, want %v", m.Via, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	full := Message{Via: make([]string, maxVia)}
+	if m := nodes[0].hop(full); len(m.Via) != maxVia {
+		t.Errorf("hop of a message with a full Via made %d entries, want %d", len(m.Via), maxVia)
+	}
+}
@@ -0,0 +1,328 @@
+package peer
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Message priorities.
+//
+// Each peer has three queues, emptied in order: control messages, urgent chat
+// messages, and other chat messages and presence announcements, which are the
+// channel returned by Add. Control messages are only exchanged between
+// neighbours, and aren't dropped while the peer reads them; a peer that lets
+// maxControl of them pile up isn't reading, and is hung up on, which discards
+// everything queued for it. Chat messages and announcements come from
+// anywhere in the mesh, so they are dropped when their queue is full, and
+// sent again later if the peer acknowledges them.
+
+const (
+	queueLen   = 32   // chat messages buffered for each peer and priority before further ones are dropped
+	maxControl = 1024 // control messages buffered for a peer before hanging up
+)
+
+// Peers is a registry of the peers a Node is connected to, keyed by their
+// listen address. Each peer has a channel feeding its outgoing connection.
+type Peers struct {
+	m  map[string]*peerConn
+	mu sync.RWMutex
+}
+
+// Weights of a new round-trip time in the moving average and in the jitter,
+// as in TCP's estimator (RFC 6298).
+const (
+	rttGain    = 1.0 / 8
+	jitterGain = 1.0 / 4
+)
+
+// peerConn is the registry entry for one outgoing connection.
+type peerConn struct {
+	addr      string
+	ch        chan Message  // chat messages
+	ready     chan struct{} // signalled when a message is added to control or urgent
+	quit      chan struct{} // closed to hang up
+	closeQuit sync.Once
+	connected time.Time     // zero while dialling
+	rtt       time.Duration // moving average of the round-trip time; zero until measured
+	jitter    time.Duration // moving average of the deviation from rtt
+
+	mu      sync.Mutex
+	control []Message
+	urgent  []Message
+}
+
+// push queues m according to its priority, and reports whether there was
+// room for it.
+func (pc *peerConn) push(m Message) bool {
+	control := m.Kind != ""
+	if !control && !m.Urgent {
+		select {
+		case pc.ch <- m:
+			return true
+		default:
+			return false
+		}
+	}
+	pc.mu.Lock()
+	switch {
+	case control:
+		pc.control = append(pc.control, m)
+		if len(pc.control) >= maxControl {
+			pc.hangUp()
+		}
+	case len(pc.urgent) < queueLen:
+		pc.urgent = append(pc.urgent, m)
+	default:
+		pc.mu.Unlock()
+		return false
+	}
+	pc.mu.Unlock()
+	select {
+	case pc.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take removes and returns the control and urgent messages queued, in the
+// order they are to be sent.
+func (pc *peerConn) take() []Message {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if len(pc.control)+len(pc.urgent) == 0 {
+		return nil
+	}
+	l := append(pc.control, pc.urgent...)
+	pc.control, pc.urgent = nil, nil
+	return l
+}
+
+// queued returns the number of messages waiting to be sent.
+func (pc *peerConn) queued() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.control) + len(pc.urgent) + len(pc.ch)
+}
+
+// hangUp asks the connection to close.
+func (pc *peerConn) hangUp() {
+	pc.closeQuit.Do(func() { close(pc.quit) })
+}
+
+// PeerInfo describes an entry of a Peers registry.
+type PeerInfo struct {
+	Addr      string
+	Connected bool          // false while the peer is being dialled
+	Since     time.Time     // when the connection was established
+	Queued    int           // messages waiting to be sent
+	RTT       time.Duration // moving average of the round-trip time; zero until measured
+	Jitter    time.Duration // moving average of the deviation of round trips from RTT
+}
+
+// NewPeers returns an empty registry.
+func NewPeers() *Peers {
+	return &Peers{m: make(map[string]*peerConn)}
+}
+
+// Add creates and returns a new channel for the given peer address.
+// If an address already exists in the registry, it returns nil.
+func (p *Peers) Add(addr string) <-chan Message {
+	if pc := p.add(addr); pc != nil {
+		return pc.ch
+	}
+	return nil
+}
+
+func (p *Peers) add(addr string) *peerConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.m[addr]; ok {
+		return nil
+	}
+	pc := &peerConn{
+		addr:  addr,
+		ch:    make(chan Message, queueLen),
+		ready: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+	p.m[addr] = pc
+	return pc
+}
+
+// Remove deletes the specified peer from the registry.
+func (p *Peers) Remove(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, addr)
+}
+
+// setConnected records that the connection to addr has been established.
+func (p *Peers) setConnected(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.m[addr]; ok {
+		pc.connected = time.Now()
+	}
+}
+
+// setRTT adds a round-trip time measured on the connection to addr to its
+// moving averages.
+func (p *Peers) setRTT(addr string, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.m[addr]
+	if !ok {
+		return
+	}
+	if pc.rtt == 0 {
+		pc.rtt, pc.jitter = rtt, rtt/2
+		return
+	}
+	dev := pc.rtt - rtt
+	if dev < 0 {
+		dev = -dev
+	}
+	pc.jitter += time.Duration(jitterGain * float64(dev-pc.jitter))
+	pc.rtt += time.Duration(rttGain * float64(rtt-pc.rtt))
+}
+
+// hangUp asks the connection to addr to close.
+// It reports whether the peer was in the registry.
+func (p *Peers) hangUp(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.m[addr]
+	if ok {
+		pc.hangUp()
+	}
+	return ok
+}
+
+// Get returns the channel for the given peer address, or nil if the peer is
+// not in the registry.
+func (p *Peers) Get(addr string) chan<- Message {
+	if pc := p.get(addr); pc != nil {
+		return pc.ch
+	}
+	return nil
+}
+
+// get returns the entry for the given peer address, or nil if the peer is
+// not in the registry.
+func (p *Peers) get(addr string) *peerConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.m[addr]
+}
+
+// List returns a slice of all active peer channels.
+func (p *Peers) List() []chan<- Message {
+	return channels(p.list())
+}
+
+// list returns the entries of all registered peers.
+func (p *Peers) list() []*peerConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l := make([]*peerConn, 0, len(p.m))
+	for _, pc := range p.m {
+		l = append(l, pc)
+	}
+	return l
+}
+
+// channels returns the chat message channels of the entries in l.
+func channels(l []*peerConn) []chan<- Message {
+	chs := make([]chan<- Message, len(l))
+	for i, pc := range l {
+		chs[i] = pc.ch
+	}
+	return chs
+}
+
+// Addrs returns the addresses of all registered peers.
+func (p *Peers) Addrs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l := make([]string, 0, len(p.m))
+	for addr := range p.m {
+		l = append(l, addr)
+	}
+	return l
+}
+
+// Info describes all registered peers, sorted by address.
+func (p *Peers) Info() []PeerInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l := make([]PeerInfo, 0, len(p.m))
+	for addr, pc := range p.m {
+		l = append(l, PeerInfo{
+			Addr:      addr,
+			Connected: !pc.connected.IsZero(),
+			Since:     pc.connected,
+			Queued:    pc.queued(),
+			RTT:       pc.rtt,
+			Jitter:    pc.jitter,
+		})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Addr < l[j].Addr })
+	return l
+}
+
+// Len returns the number of registered peers.
+func (p *Peers) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.m)
+}
+
+// Sample returns the channels of up to k peers chosen at random, favouring
+// those with a lower round-trip time: a peer half as far away is twice as
+// likely to be chosen. Peers not measured yet count as average.
+func (p *Peers) Sample(k int) []chan<- Message {
+	return channels(p.sample(k))
+}
+
+// sample is Sample returning registry entries.
+func (p *Peers) sample(k int) []*peerConn {
+	p.mu.RLock()
+	type entry struct {
+		pc  *peerConn
+		key float64
+	}
+	l := make([]entry, 0, len(p.m))
+	var sum time.Duration
+	measured := 0
+	for _, pc := range p.m {
+		if pc.rtt > 0 {
+			sum += pc.rtt
+			measured++
+		}
+	}
+	avg := time.Millisecond
+	if measured > 0 {
+		avg = sum / time.Duration(measured)
+	}
+	for _, pc := range p.m {
+		rtt := pc.rtt
+		if rtt == 0 {
+			rtt = avg
+		}
+		// Taking the k smallest keys is weighted sampling without
+		// replacement, with weights 1/rtt.
+		l = append(l, entry{pc, rand.ExpFloat64() * float64(rtt)})
+	}
+	p.mu.RUnlock()
+	if k < len(l) {
+		sort.Slice(l, func(i, j int) bool { return l[i].key < l[j].key })
+		l = l[:k]
+	}
+	pcs := make([]*peerConn, len(l))
+	for i, e := range l {
+		pcs[i] = e.pc
+	}
+	return pcs
+}
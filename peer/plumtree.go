@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// tree holds the Plumtree state of a Node: which peers only receive IHAVE
+// announcements (all others receive messages eagerly), and the announced
+// messages that have not arrived yet.
+type tree struct {
+	mu      sync.Mutex
+	lazy    map[string]bool
+	missing map[string]*announced
+}
+
+// announced tracks a message that peers announced but nobody has sent.
+type announced struct {
+	from  []string // peers that announced the message, oldest first
+	timer transport.Timer
+}
+
+func newTree() *tree {
+	return &tree{
+		lazy:    make(map[string]bool),
+		missing: make(map[string]*announced),
+	}
+}
+
+// isLazy reports whether the peer at addr only receives announcements.
+func (t *tree) isLazy(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lazy[addr]
+}
+
+// setLazy moves the peer at addr to the lazy or the eager set.
+func (t *tree) setLazy(addr string, lazy bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lazy {
+		t.lazy[addr] = true
+	} else {
+		delete(t.lazy, addr)
+	}
+}
+
+// forget drops the state of a peer whose connection was closed, so that it
+// starts out eager if it comes back.
+func (t *tree) forget(addr string) {
+	t.setLazy(addr, false)
+}
+
+// arrived records that message id was received from the peer at from,
+// which becomes part of the tree.
+func (t *tree) arrived(id, from string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.missing[id]; ok {
+		a.timer.Stop()
+		delete(t.missing, id)
+	}
+	if from != "" {
+		delete(t.lazy, from)
+	}
+}
+
+// pushTree sends m to the eager peers and announces it to the lazy peers,
+// skipping the peer it came from.
+func (n *Node) pushTree(m Message, from string) {
+	for _, addr := range n.peers.Addrs() {
+		if addr == from {
+			continue
+		}
+		pc := n.peers.get(addr)
+		if pc == nil {
+			continue // Peer went away.
+		}
+		if n.tree.isLazy(addr) {
+			n.send(pc, Message{Kind: KindIHave, Addr: n.self, IDs: []string{m.ID}})
+		} else {
+			n.send(pc, m)
+		}
+	}
+}
+
+// prune removes the link to the peer at addr from the tree after it sent a
+// duplicate, and asks the peer to do the same.
+func (n *Node) prune(addr string) {
+	if addr == "" {
+		return // Peer did not say hello; can't tell who it is.
+	}
+	n.tree.setLazy(addr, true)
+	if pc := n.peers.get(addr); pc != nil {
+		n.send(pc, Message{Kind: KindPrune, Addr: n.self})
+	}
+}
+
+// handleIHave starts waiting for the messages announced by the peer at from
+// that this node has not seen. If one doesn't arrive within GraftTimeout, it
+// is grafted from the announcer.
+func (n *Node) handleIHave(m Message, from string) {
+	n.tree.mu.Lock()
+	defer n.tree.mu.Unlock()
+	for _, id := range m.IDs {
+		if n.seen.Has(id) {
+			continue
+		}
+		a, ok := n.tree.missing[id]
+		if !ok {
+			id := id
+			a = &announced{}
+			a.timer = n.cfg.Clock.AfterFunc(n.cfg.GraftTimeout, func() { n.graft(id) })
+			n.tree.missing[id] = a
+		}
+		a.from = append(a.from, from)
+	}
+}
+
+// graft asks the oldest remaining announcer of message id to send it and to
+// put the link back into the tree. Other announcers are tried in turn, at
+// shorter intervals, until the message arrives.
+func (n *Node) graft(id string) {
+	n.tree.mu.Lock()
+	a, ok := n.tree.missing[id]
+	if !ok || n.seen.Has(id) {
+		delete(n.tree.missing, id)
+		n.tree.mu.Unlock()
+		return
+	}
+	addr := a.from[0]
+	a.from = a.from[1:]
+	if len(a.from) > 0 {
+		a.timer.Reset(n.cfg.GraftTimeout / 2)
+	} else {
+		delete(n.tree.missing, id)
+	}
+	delete(n.tree.lazy, addr)
+	n.tree.mu.Unlock()
+
+	pc := n.peers.get(addr)
+	if pc == nil {
+		return
+	}
+	n.logOut(addr).Debug("graft", util.LogID, id)
+	n.limits.ask(addr, 1)
+	n.send(pc, Message{Kind: KindGraft, Addr: n.self, IDs: []string{id}})
+}
+
+// handleGraft puts the link to the peer at from back into the tree and sends
+// it the requested messages.
+func (n *Node) handleGraft(m Message, from string) {
+	n.tree.setLazy(from, false)
+	pc := n.peers.get(from)
+	if pc == nil {
+		return
+	}
+	for _, id := range m.IDs {
+		if hm, ok := n.lookup(id); ok {
+			n.send(pc, hm)
+		}
+	}
+}
+
+// handlePrune stops sending messages eagerly to the peer at from.
+func (n *Node) handlePrune(from string) {
+	n.tree.setLazy(from, true)
+}
@@ -0,0 +1,229 @@
+package peer
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// Presence announcements.
+//
+// A node with Config.Keepalive set announces itself to the whole mesh with a
+// chat message whose Presence is "join" once it first connects to a peer,
+// "alive" every Keepalive after that, and "leave" when it is closed. Every
+// node keeps a roster of the nodes it has heard from, announcements and chat
+// messages alike, and forgets those it hasn't heard from for three times its
+// keepalive interval.
+
+// Values of Message.Presence.
+const (
+	PresenceJoin  = "join"
+	PresenceAlive = "alive"
+	PresenceLeave = "leave"
+)
+
+const (
+	defaultKeepalive = 30 * time.Second
+	rosterTimeouts   = 3                      // keepalive intervals before a silent node is forgotten
+	leaveTimeout     = 500 * time.Millisecond // time Close waits for the leave announcement to go out
+)
+
+// Member is an entry of a node's roster.
+type Member struct {
+	ID       string // empty for nodes that don't send one
+	Addr     string
+	Nick     string
+	LastSeen time.Time
+}
+
+// key returns the key of m in a roster: its ID if it has one, so that a
+// node that restarts with a new address keeps its entry.
+func (m Member) key() string {
+	if m.ID != "" {
+		return m.ID
+	}
+	return m.Addr
+}
+
+// roster records the nodes heard from recently.
+type roster struct {
+	mu sync.Mutex
+	m  map[string]Member
+}
+
+func newRoster() *roster {
+	return &roster{m: make(map[string]Member)}
+}
+
+// see records m, and reports whether it is new to the roster.
+func (r *roster) see(m Member) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.m[m.key()]
+	r.m[m.key()] = m
+	return !ok
+}
+
+// remove forgets m, and reports whether it was in the roster.
+func (r *roster) remove(m Member) (Member, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.m[m.key()]
+	delete(r.m, m.key())
+	return old, ok
+}
+
+// list forgets the nodes last seen before the given time and returns the
+// others, sorted by nickname and address.
+func (r *roster) list(before time.Time) []Member {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := make([]Member, 0, len(r.m))
+	for k, m := range r.m {
+		if m.LastSeen.Before(before) {
+			delete(r.m, k)
+			continue
+		}
+		l = append(l, m)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Nick != l[j].Nick {
+			return l[i].Nick < l[j].Nick
+		}
+		return l[i].Addr < l[j].Addr
+	})
+	return l
+}
+
+// Roster returns the nodes in the mesh this node has heard from recently,
+// itself included.
+func (n *Node) Roster() []Member {
+	now := n.cfg.Clock.Now()
+	keepalive := n.cfg.Keepalive
+	if keepalive <= 0 {
+		keepalive = defaultKeepalive
+	}
+	n.roster.see(Member{ID: n.id, Addr: n.self, Nick: n.Nick(), LastSeen: now})
+	return n.roster.list(now.Add(-rosterTimeouts * keepalive))
+}
+
+// announce sends a presence announcement to the mesh.
+func (n *Node) announce(presence string) {
+	m := Message{
+		ID:       util.RandomID(),
+		Addr:     n.self,
+		Nick:     n.Nick(),
+		From:     n.id,
+		Presence: presence,
+	}
+	n.Seen(m.ID)
+	n.relay(m, "")
+}
+
+// join announces the node the first time it connects to a peer.
+func (n *Node) join() {
+	if n.cfg.Keepalive <= 0 || atomic.SwapInt32(&n.joined, 1) != 0 {
+		return
+	}
+	n.announce(PresenceJoin)
+}
+
+// keepalive announces the node every Keepalive.
+func (n *Node) keepalive() {
+	for range n.cfg.Clock.Tick(n.cfg.Keepalive) {
+		if n.isClosed() {
+			return
+		}
+		if atomic.LoadInt32(&n.joined) != 0 {
+			n.announce(PresenceAlive)
+		}
+	}
+}
+
+// leave announces that the node is leaving, and waits a little for the
+// announcement to be sent.
+func (n *Node) leave() {
+	if n.cfg.Keepalive <= 0 || atomic.LoadInt32(&n.joined) == 0 {
+		return
+	}
+	n.announce(PresenceLeave)
+	deadline := time.Now().Add(leaveTimeout)
+	for time.Now().Before(deadline) {
+		queued := 0
+		for _, p := range n.peers.Info() {
+			if p.Connected {
+				queued += p.Queued
+			}
+		}
+		if queued == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receivePresence handles a presence announcement received from a peer.
+func (n *Node) receivePresence(m Message, from string) {
+	duplicate := func() {
+		atomic.AddInt64(&n.stats.Duplicates, 1)
+		if n.cfg.Mode == Plumtree {
+			n.prune(from)
+		}
+	}
+	if n.seen.Has(m.ID) {
+		duplicate()
+		return
+	}
+	if !n.withinLimits(m, from) {
+		return
+	}
+	if n.Seen(m.ID) {
+		duplicate()
+		return
+	}
+	if m.Presence == PresenceLeave {
+		n.dropOutbox(m.Addr)
+		if mb, ok := n.roster.remove(Member{ID: m.From, Addr: m.Addr}); ok {
+			n.log.Info("left", util.LogOrigin, m.Addr, "nick", m.Nick)
+			n.presenceChanged(PresenceLeave, mb)
+		}
+	} else {
+		n.learnName(m)
+		n.see(m)
+	}
+	if n.cfg.Mode == Plumtree {
+		n.tree.arrived(m.ID, from)
+	}
+	n.relay(n.hop(m), from)
+}
+
+// see records the sender of a chat message or announcement in the roster
+// and the routing table.
+func (n *Node) see(m Message) {
+	if m.Addr == "" {
+		return // From a code lab program.
+	}
+	if m.From == n.id && m.Addr != n.self {
+		// It would take the place of this node in the roster.
+		if atomic.CompareAndSwapInt32(&n.clashed, 0, 1) {
+			n.log.Warn("another node uses this node's ID", util.LogOrigin, m.Addr, util.LogID, m.From)
+		}
+		return
+	}
+	n.learn(Contact{ID: m.From, Addr: m.Addr})
+	mb := Member{ID: m.From, Addr: m.Addr, Nick: m.Nick, LastSeen: n.cfg.Clock.Now()}
+	if n.roster.see(mb) {
+		n.log.Info("joined", util.LogOrigin, m.Addr, "nick", m.Nick)
+		n.presenceChanged(PresenceJoin, mb)
+	}
+}
+
+// presenceChanged passes a change of the roster to Config.PresenceChanged.
+func (n *Node) presenceChanged(event string, m Member) {
+	if n.cfg.PresenceChanged != nil {
+		n.cfg.PresenceChanged(event, m)
+	}
+}
@@ -0,0 +1,80 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+// rosterOf returns the nicknames in the roster of n.
+func rosterOf(n *Node) string {
+	var s []string
+	for _, m := range n.Roster() {
+		s = append(s, m.Nick)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestPresence(t *testing.T) {
+	const n = 3
+	events := make(chan string, 10*n)
+	nodes, _ := startMesh(t, n, Config{
+		Keepalive: 50 * time.Millisecond,
+		PresenceChanged: func(event string, m Member) {
+			events <- event + " " + m.Nick
+		},
+	})
+	for i, nd := range nodes {
+		nd.SetNick(fmt.Sprint("gopher", i))
+	}
+	for _, nd := range nodes {
+		nd := nd
+		waitFor(t, 5*time.Second, "the roster of "+nd.Addr(), func() bool {
+			return rosterOf(nd) == "[gopher0 gopher1 gopher2]"
+		})
+	}
+
+	nodes[2].Close()
+	waitFor(t, 5*time.Second, "gopher2 to leave", func() bool {
+		return rosterOf(nodes[0]) == "[gopher0 gopher1]" && rosterOf(nodes[1]) == "[gopher0 gopher1]"
+	})
+	left := 0
+	for len(events) > 0 {
+		if <-events == "leave gopher2" {
+			left++
+		}
+	}
+	if left != n-1 {
+		t.Errorf("got %d leave events for gopher2, want %d", left, n-1)
+	}
+}
+
+func TestRosterExpiry(t *testing.T) {
+	clock := transport.NewFakeClock()
+	n := newTestNode(t, Config{Clock: clock, Keepalive: time.Second})
+	n.SetNick("self")
+	n.see(Message{Addr: "10.0.0.1:4000", Nick: "quiet"})
+	clock.Advance(2 * time.Second)
+	n.see(Message{Addr: "10.0.0.2:4000", Nick: "chatty"})
+	if got, want := rosterOf(n), "[chatty quiet self]"; got != want {
+		t.Errorf("roster = %v, want %v", got, want)
+	}
+	clock.Advance(2 * time.Second)
+	if got, want := rosterOf(n), "[chatty self]"; got != want {
+		t.Errorf("roster after 4s = %v, want %v", got, want)
+	}
+}
+
+func TestIDClash(t *testing.T) {
+	n := newTestNode(t, Config{})
+	n.SetNick("self")
+	n.see(Message{Addr: "10.0.0.1:4000", From: n.ID(), Nick: "twin"})
+	if got, want := rosterOf(n), "[self]"; got != want {
+		t.Errorf("roster = %v, want %v", got, want)
+	}
+	if n.clashed == 0 {
+		t.Error("node using the same ID not noticed")
+	}
+}
@@ -0,0 +1,92 @@
+package peer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+)
+
+// errWrongKey is reported when a peer doesn't prove it knows the network key.
+var errWrongKey = errors.New("peer doesn't know the network key")
+
+// newNonce returns a random challenge for Message.Nonce.
+func newNonce() string {
+	b := make([]byte, nonceLen/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sign returns the MAC of m made with the network key: an HMAC-SHA256 of
+// nonce followed by the binary encoding of m without its MAC. Nonce is the
+// peer's challenge in a hello or welcome, and empty in any other message.
+func (n *Node) sign(m Message, nonce string) string {
+	m.MAC = ""
+	h := hmac.New(sha256.New, n.cfg.NetworkKey)
+	h.Write([]byte(nonce))
+	h.Write(m.appendBinary(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verify reports whether m carries the MAC made by sign.
+func (n *Node) verify(m Message, nonce string) bool {
+	return m.MAC != "" && hmac.Equal([]byte(m.MAC), []byte(n.sign(m, nonce)))
+}
+
+// proveKey runs the dialer's side of the network key handshake on a new
+// connection: it answers the acceptor's challenge with hello, and returns the
+// acceptor's welcome once it proves the acceptor knows the key too.
+func (n *Node) proveKey(c net.Conn, d *frameDecoder, e *outStream, hello Message) (Message, error) {
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var ch Message
+	if err := decodeValid(d, &ch); err != nil {
+		return Message{}, err
+	}
+	if ch.Kind != KindChallenge || ch.Nonce == "" {
+		return Message{}, errors.New("expected a challenge")
+	}
+	hello.Nonce = newNonce()
+	hello.MAC = n.sign(hello, ch.Nonce)
+	if err := e.Encode(hello); err != nil {
+		return Message{}, err
+	}
+	if err := e.Flush(); err != nil {
+		return Message{}, err
+	}
+
+	var w Message
+	if err := decodeValid(d, &w); err != nil {
+		return Message{}, err
+	}
+	if w.Kind != KindWelcome || !n.verify(w, hello.Nonce) {
+		return Message{}, errWrongKey
+	}
+	return w, nil
+}
+
+// admit checks the MAC of a message received on a connection on which the
+// peer's hello, if any, came from the given address, and on which challenge
+// was sent. The first message must be a hello answering the challenge.
+func (n *Node) admit(m *Message, from, challenge string) bool {
+	var ok bool
+	if from == "" {
+		ok = m.Kind == KindHello && n.verify(*m, challenge)
+	} else {
+		ok = n.verify(*m, "")
+	}
+	m.MAC = ""
+	return ok
+}
+
+// decodeValid decodes the next message from d and validates it.
+func decodeValid(d *frameDecoder, m *Message) error {
+	if err := d.Decode(m); err != nil {
+		return err
+	}
+	return m.validate()
+}
@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+func TestNetworkKeyMesh(t *testing.T) {
+	const n = 3
+	nodes, delivered := startMesh(t, n, Config{NetworkKey: []byte("secret"), Codec: CodecBinary, Compress: true})
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+}
+
+func TestWrongNetworkKey(t *testing.T) {
+	delivered := make(chan Message, 1)
+	n := newTestNode(t, Config{
+		NetworkKey: []byte("secret"),
+		Deliver:    func(m Message) { delivered <- m },
+	})
+
+	// A node with another key can't connect.
+	other := newTestNode(t, Config{NetworkKey: []byte("guess")})
+	other.Dial(n.Addr())
+	if s := n.Stats(); s.BadFrames != 1 {
+		t.Errorf("Stats().BadFrames = %d, want 1", s.BadFrames)
+	}
+
+	// Neither can a code lab program, which knows nothing about keys.
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, `{"ID": %q, "Addr": "", "Body": "hi"}`, util.RandomID())
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatal("connection not closed")
+	}
+	select {
+	case m := <-delivered:
+		t.Errorf("delivered %+v from a peer without the key", m)
+	default:
+	}
+}
+
+func TestSign(t *testing.T) {
+	n := &Node{cfg: Config{NetworkKey: []byte("secret")}}
+	m := testMessage
+	m.MAC = n.sign(m, "")
+	if !validHex(m.MAC, macLen) {
+		t.Fatalf("sign returned %q", m.MAC)
+	}
+	if !n.verify(m, "") {
+		t.Error("verify rejected a signed message")
+	}
+	if n.verify(m, newNonce()) {
+		t.Error("verify accepted a message signed with another nonce")
+	}
+	tampered := m
+	tampered.Body = "Ahoy! Is anybody in there?"
+	if n.verify(tampered, "") {
+		t.Error("verify accepted a tampered message")
+	}
+	other := &Node{cfg: Config{NetworkKey: []byte("guess")}}
+	if other.verify(m, "") {
+		t.Error("verify accepted a message signed with another key")
+	}
+}
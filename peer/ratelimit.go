@@ -0,0 +1,259 @@
+package peer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+const (
+	// maxOrigins bounds the number of per-origin buckets kept before idle
+	// ones are discarded.
+	maxOrigins = 1024
+	// grantTimeout is how long a peer has to send the messages this node
+	// asked it for outside the rate limits.
+	grantTimeout = 5 * time.Second
+)
+
+// bucket is a token bucket: it holds up to burst tokens and refills at rate
+// tokens per second. Each message takes one token.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take reports whether a token was available at time now, and takes it.
+// A rate of zero means no limit.
+func (b *bucket) take(rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limits are the rate limits of a node, set from its Config and changed
+// while it runs with SetLimits. The fields are those of Config.
+type Limits struct {
+	ConnRate    float64
+	ConnBurst   int
+	OriginRate  float64
+	OriginBurst int
+	Penalty     time.Duration
+}
+
+// grant is the number of messages a peer may still send outside the
+// connection and origin rate limits, because this node asked for them in a
+// push-pull round, a pull or a graft.
+type grant struct {
+	conn, origin int
+	until        time.Time
+}
+
+// limiter enforces the per-origin rate limit and remembers which peers are
+// disconnected for exceeding a limit.
+type limiter struct {
+	mu        sync.Mutex
+	cur       Limits
+	origins   map[string]*bucket
+	penalties map[string]time.Time // address -> end of penalty
+	grants    map[string]*grant    // address -> messages asked for
+	clock     transport.Clock
+}
+
+func newLimiter(clock transport.Clock, lim Limits) *limiter {
+	return &limiter{
+		cur:       lim,
+		clock:     clock,
+		origins:   make(map[string]*bucket),
+		penalties: make(map[string]time.Time),
+		grants:    make(map[string]*grant),
+	}
+}
+
+// get returns the current limits.
+func (l *limiter) get() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cur
+}
+
+// set replaces the current limits.
+func (l *limiter) set(lim Limits) {
+	if lim.Penalty == 0 {
+		lim.Penalty = defaultPenalty
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cur = lim
+}
+
+// allowOrigin takes a token from the bucket of the given origin address.
+func (l *limiter) allowOrigin(addr string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.origins[addr]
+	if !ok {
+		if len(l.origins) >= maxOrigins {
+			l.dropIdle(now, rate, burst)
+		}
+		b = &bucket{}
+		l.origins[addr] = b
+	}
+	return b.take(rate, burst, now)
+}
+
+// dropIdle discards the buckets that have refilled completely, as they are
+// indistinguishable from new ones. The caller must hold l.mu.
+func (l *limiter) dropIdle(now time.Time, rate float64, burst int) {
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	for addr, b := range l.origins {
+		if now.Sub(b.last) >= full {
+			delete(l.origins, addr)
+		}
+	}
+}
+
+// ask records that this node asked the peer at addr for up to k messages,
+// which it accepts outside the rate limits for grantTimeout.
+func (l *limiter) ask(addr string, k int) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for a, g := range l.grants {
+		if now.After(g.until) {
+			delete(l.grants, a)
+		}
+	}
+	g, ok := l.grants[addr]
+	if !ok {
+		g = &grant{}
+		l.grants[addr] = g
+	}
+	g.conn += k
+	g.origin += k
+	g.until = now.Add(grantTimeout)
+}
+
+// granted reports whether the peer at addr may send one more message
+// outside the connection rate limit or, if origin is set, the origin rate
+// limit, and counts it.
+func (l *limiter) granted(addr string, origin bool) bool {
+	if addr == "" {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g, ok := l.grants[addr]
+	if !ok || l.clock.Now().After(g.until) {
+		return false
+	}
+	left := &g.conn
+	if origin {
+		left = &g.origin
+	}
+	if *left <= 0 {
+		return false
+	}
+	*left--
+	return true
+}
+
+// penalise marks addr as disconnected for the duration d, unless it already
+// is for longer.
+func (l *limiter) penalise(addr string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := l.clock.Now().Add(d)
+	if until.After(l.penalties[addr]) {
+		l.penalties[addr] = until
+	}
+}
+
+// pardon ends the penalty of addr.
+func (l *limiter) pardon(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.penalties, addr)
+}
+
+// penalised reports whether addr is serving a penalty.
+func (l *limiter) penalised(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.penalties[addr]
+	if ok && l.clock.Now().After(until) {
+		delete(l.penalties, addr)
+		ok = false
+	}
+	return ok
+}
+
+// Limits returns the rate limits in force.
+func (n *Node) Limits() Limits { return n.limits.get() }
+
+// SetLimits replaces the rate limits of the node. They apply to the messages
+// received from then on, on existing connections too.
+func (n *Node) SetLimits(lim Limits) { n.limits.set(lim) }
+
+// withinLimits reports whether the new message m, received from the peer at
+// from, is within the limits of its origin, and counts it as limited if not.
+// Callers check it before marking m seen, so that a message dropped here can
+// still arrive later. Honest relays pass on the messages of a noisy origin,
+// and any relay can claim an origin, so messages over the origin rate limit
+// are only dropped; the peer is penalised only if it is the origin itself.
+// Messages this node asked from for are exempt from the origin rate limit.
+func (n *Node) withinLimits(m Message, from string) bool {
+	if n.limits.penalised(m.Addr) {
+		atomic.AddInt64(&n.stats.Limited, 1)
+		return false
+	}
+	if n.limits.granted(from, true) {
+		return true
+	}
+	if lim := n.limits.get(); !n.limits.allowOrigin(m.Addr, lim.OriginRate, lim.OriginBurst) {
+		atomic.AddInt64(&n.stats.Limited, 1)
+		if from != "" && from == m.Addr {
+			n.penalise(from, "exceeded origin rate limit")
+		}
+		return false
+	}
+	return true
+}
+
+// penalise disconnects the peer at addr, which exceeded a rate limit or
+// otherwise misbehaved, and refuses to talk to it until the penalty in its
+// Limits has passed. Addr must be the listen address of the neighbour that
+// misbehaved, never the claimed origin of a message, which anyone can forge:
+// the penalty counts towards a ban.
+func (n *Node) penalise(addr, reason string) {
+	atomic.AddInt64(&n.stats.Penalties, 1)
+	if addr == "" {
+		return // Unknown peer; closing its connection is all we can do.
+	}
+	penalty := n.limits.get().Penalty
+	n.log.Warn("penalised", util.LogPeer, addr, "reason", reason, "penalty", penalty)
+	n.limits.penalise(addr, penalty)
+	n.Disconnect(addr)
+	n.dropOutbox(addr)
+	n.misbehaved(addr, scorePenalty, reason)
+}
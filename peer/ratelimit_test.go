@@ -0,0 +1,203 @@
+package peer
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !b.take(1, 3, now) {
+			t.Fatalf("take %d of burst refused", i)
+		}
+	}
+	if b.take(1, 3, now) {
+		t.Fatal("take beyond burst allowed")
+	}
+	if !b.take(1, 3, now.Add(time.Second)) {
+		t.Fatal("take after refill refused")
+	}
+	if b.take(1, 3, now.Add(time.Second)) {
+		t.Fatal("second take after refilling one token allowed")
+	}
+}
+
+func newTestNode(t *testing.T, cfg Config) *Node {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	n := New(l, cfg)
+	go n.Serve()
+	return n
+}
+
+func TestOriginRateLimit(t *testing.T) {
+	delivered := 0
+	clock := transport.NewFakeClock()
+	n := newTestNode(t, Config{
+		OriginRate:  0.001,
+		OriginBurst: 2,
+		Clock:       clock,
+		Deliver:     func(Message) { delivered++ },
+	})
+	// Nobody listens at these.
+	const origin, relay = "127.0.0.1:1", "127.0.0.1:2"
+	for _, id := range []string{"a", "b", "c", "d"} {
+		n.receive(Message{ID: id, Addr: origin}, relay)
+	}
+	if delivered != 2 {
+		t.Errorf("delivered %d messages, want 2", delivered)
+	}
+	s := n.Stats()
+	if s.Limited != 2 || s.Penalties != 0 {
+		t.Errorf("Limited, Penalties = %d, %d; want 2, 0", s.Limited, s.Penalties)
+	}
+	if n.limits.penalised(relay) || n.limits.penalised(origin) {
+		t.Error("relay or claimed origin penalised")
+	}
+
+	// A dropped message isn't marked seen, so it gets in once the origin
+	// is within its limit again.
+	clock.Advance(time.Hour)
+	n.receive(Message{ID: "c", Addr: origin}, relay)
+	if delivered != 3 {
+		t.Errorf("delivered %d messages after the limit refilled, want 3", delivered)
+	}
+
+	// An origin over the limit that sends its messages itself is penalised.
+	for _, id := range []string{"e", "f", "g"} {
+		n.receive(Message{ID: id, Addr: origin}, origin)
+	}
+	if !n.limits.penalised(origin) {
+		t.Error("origin sending over its limit not penalised")
+	}
+}
+
+func TestOriginRateLimitPaths(t *testing.T) {
+	const origin, relay = "127.0.0.1:1", "127.0.0.1:2"
+	for _, tt := range []struct {
+		name string
+		m    Message
+	}{
+		{"chat", Message{Body: "hi"}},
+		{"direct", Message{Body: "hi"}},
+		{"routed", Message{Body: "hi", Target: "0123456789abcdef"}},
+		{"presence", Message{Presence: PresenceJoin, From: "0123456789abcdef"}},
+	} {
+		n := newTestNode(t, Config{OriginRate: 0.001, OriginBurst: 2})
+		for _, id := range []string{"a", "b", "c", "d"} {
+			m := tt.m
+			m.ID, m.Addr = id, origin
+			if tt.name == "direct" {
+				m.To = n.Addr()
+			}
+			n.receive(m, relay)
+		}
+		if s := n.Stats(); s.Limited != 2 {
+			t.Errorf("%s: Limited = %d, want 2", tt.name, s.Limited)
+		}
+	}
+}
+
+func TestConnRateLimit(t *testing.T) {
+	n := newTestNode(t, Config{ConnRate: 0.001, ConnBurst: 3})
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e := json.NewEncoder(c)
+	const self = "127.0.0.1:1"
+	e.Encode(Message{Kind: KindHello, Addr: self})
+	for i := 0; i < 10; i++ {
+		if err := e.Encode(Message{ID: util.RandomID(), Addr: self}); err != nil {
+			break // Disconnected.
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want connection closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed after exceeding the rate limit")
+	}
+	if !n.limits.penalised(self) {
+		t.Error("peer not penalised after exceeding the rate limit")
+	}
+}
+
+func TestGrantedReplies(t *testing.T) {
+	delivered := make(chan Message, 4)
+	n := newTestNode(t, Config{
+		ConnRate:    0.001,
+		ConnBurst:   1,
+		OriginRate:  0.001,
+		OriginBurst: 1,
+		NoDiscover:  true,
+		Deliver:     func(m Message) { delivered <- m },
+	})
+	// Nobody listens at these.
+	const self, origin = "127.0.0.1:1", "127.0.0.1:2"
+	// As if n had sent self a pull for three messages.
+	n.limits.ask(self, 3)
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e := json.NewEncoder(c)
+	e.Encode(Message{Kind: KindHello, Addr: self})
+	for i := 0; i < 3; i++ {
+		e.Encode(Message{ID: util.RandomID(), Addr: origin, Body: "reply"})
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivered %d replies, want 3", i)
+		}
+	}
+	if n.limits.penalised(self) {
+		t.Error("peer penalised for sending the messages it was asked for")
+	}
+
+	// Once the grant is used up, the limits apply again.
+	e.Encode(Message{ID: util.RandomID(), Addr: origin, Body: "more"})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want connection closed")
+	}
+	if !n.limits.penalised(self) {
+		t.Error("peer not penalised after exceeding the rate limit")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	delivered := 0
+	n := newTestNode(t, Config{Deliver: func(Message) { delivered++ }})
+	const origin = "127.0.0.1:1" // Nobody listens here.
+	for _, id := range []string{"a", "b", "c"} {
+		n.receive(Message{ID: id, Addr: origin}, "")
+	}
+	n.SetLimits(Limits{OriginRate: 0.001, OriginBurst: 1})
+	if got := n.Limits().Penalty; got != defaultPenalty {
+		t.Errorf("Penalty = %v after SetLimits without one, want %v", got, defaultPenalty)
+	}
+	for _, id := range []string{"d", "e"} {
+		n.receive(Message{ID: id, Addr: origin}, "")
+	}
+	if delivered != 4 {
+		t.Errorf("delivered %d messages, want 4", delivered)
+	}
+	if s := n.Stats(); s.Limited != 1 {
+		t.Errorf("Limited = %d, want 1", s.Limited)
+	}
+}
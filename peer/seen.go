@@ -0,0 +1,95 @@
+package peer
+
+import "sync"
+
+// seenSet records the IDs of the messages a Node has already handled.
+type seenSet struct {
+	m map[string]bool
+	sync.Mutex
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{m: make(map[string]bool)}
+}
+
+// Seen returns true if the specified id has been seen before.
+// If not, it returns false and marks the given id as "seen".
+func (s *seenSet) Seen(id string) bool {
+	s.Lock()
+	ok := s.m[id]
+	s.m[id] = true
+	s.Unlock()
+	return ok
+}
+
+// Has reports whether the specified id has been seen, without marking it.
+func (s *seenSet) Has(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.m[id]
+}
+
+// Forget forgets the specified id, so that it is handled again if it comes
+// back.
+func (s *seenSet) Forget(id string) {
+	s.Lock()
+	delete(s.m, id)
+	s.Unlock()
+}
+
+// history keeps the most recent messages handled by a Node, so that they can
+// be handed to peers that missed them.
+type history struct {
+	mu  sync.Mutex
+	max int
+	ids []string // oldest first
+	m   map[string]Message
+}
+
+func newHistory(max int) *history {
+	return &history{max: max, m: make(map[string]Message)}
+}
+
+// Add records m, evicting the oldest message if the history is full.
+func (h *history) Add(m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.max <= 0 {
+		return
+	}
+	if _, ok := h.m[m.ID]; ok {
+		return
+	}
+	if len(h.ids) >= h.max {
+		delete(h.m, h.ids[0])
+		h.ids = h.ids[1:]
+	}
+	h.ids = append(h.ids, m.ID)
+	h.m[m.ID] = m
+}
+
+// Get returns the message with the given id, if it is still remembered.
+func (h *history) Get(id string) (Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.m[id]
+	return m, ok
+}
+
+// IDs returns the IDs of the remembered messages, oldest first.
+func (h *history) IDs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.ids...)
+}
+
+// Messages returns the remembered messages, oldest first.
+func (h *history) Messages() []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := make([]Message, len(h.ids))
+	for i, id := range h.ids {
+		l[i] = h.m[id]
+	}
+	return l
+}
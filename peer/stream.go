@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"compress/flate"
+	"io"
+	"sync/atomic"
+)
+
+// CompressFlate is the only compression a node offers and accepts: a
+// compress/flate stream, flushed whenever the sender has nothing more
+// queued, so that compression never holds a message back.
+const CompressFlate = "flate"
+
+// compressMagic tells the acceptor that everything after it is compressed.
+// Like frameMagic, it can't start a JSON object.
+const compressMagic = 0xC1
+
+// outStream writes messages to a connection dialled by the node, in the
+// codec and with the compression agreed with the acceptor.
+type outStream struct {
+	wire  io.Writer     // the connection
+	flate *flate.Writer // nil unless compressing
+	codec string
+	e     encoder
+	raw   *int64 // counts bytes before compression
+}
+
+func newOutStream(c io.Writer, wire, raw *int64) *outStream {
+	s := &outStream{wire: countWriter{c, wire}, codec: CodecJSON, raw: raw}
+	s.reset()
+	return s
+}
+
+// reset makes a new encoder after the codec or compression changed.
+func (s *outStream) reset() {
+	var w io.Writer = s.wire
+	if s.flate != nil {
+		w = s.flate
+	}
+	s.e = newEncoder(countWriter{w, s.raw}, s.codec)
+}
+
+func (s *outStream) Encode(m Message) error { return s.e.Encode(m) }
+
+// setCodec switches to the given codec for the following messages.
+func (s *outStream) setCodec(codec string) {
+	s.codec = codec
+	s.reset()
+}
+
+// compress compresses everything written from now on.
+func (s *outStream) compress() error {
+	if s.flate != nil {
+		return nil
+	}
+	if _, err := s.wire.Write([]byte{compressMagic}); err != nil {
+		return err
+	}
+	// The faster levels store the short blocks produced by flushing after
+	// every message uncompressed; only the slower ones compress them
+	// against the earlier messages in the window.
+	s.flate, _ = flate.NewWriter(s.wire, flate.BestCompression)
+	s.reset()
+	return nil
+}
+
+// Flush sends any data held back by compression.
+func (s *outStream) Flush() error {
+	if s.flate == nil {
+		return nil
+	}
+	return s.flate.Flush()
+}
+
+// countWriter adds the number of bytes written through it to *n.
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countReader adds the number of bytes read through it to *n.
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,309 @@
+package peer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// TLSConfig describes the certificates a node uses to authenticate itself
+// and its peers with mutual TLS.
+type TLSConfig struct {
+	// Dir holds the generated certificate of the node, if it doesn't have
+	// one of its own, and the fingerprints pinned for its peers.
+	Dir string
+
+	// CertFile and KeyFile hold the certificate and key of the node in PEM
+	// format. If empty, a self-signed certificate is generated in Dir the
+	// first time it is needed and reused afterwards.
+	CertFile, KeyFile string
+
+	// CAFile holds the PEM certificate of a CA that signed the certificates
+	// of every peer. If empty, peers are trusted on first use: the
+	// fingerprint of a peer's certificate is pinned to its node ID, which
+	// stays the same across restarts unlike its address, in
+	// Dir/known_peers, and any later peer presenting a different
+	// certificate for that ID is rejected.
+	CAFile string
+}
+
+// Files in TLSConfig.Dir.
+const (
+	certFile       = "node.crt"
+	keyFile        = "node.key"
+	knownPeersFile = "known_peers"
+)
+
+// NewTLSConfig returns the tls.Config for Config.TLS described by c.
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	if c.CertFile == "" {
+		c.CertFile = filepath.Join(c.Dir, certFile)
+		c.KeyFile = filepath.Join(c.Dir, keyFile)
+		if _, err := os.Stat(c.CertFile); os.IsNotExist(err) {
+			if err := generateCert(c.CertFile, c.KeyFile); err != nil {
+				return nil, fmt.Errorf("generating certificate: %v", err)
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var verify func(leaf *x509.Certificate, raw [][]byte) error
+	var pinned *pins
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%v: no certificates found", c.CAFile)
+		}
+		verify = func(leaf *x509.Certificate, raw [][]byte) error {
+			inter := x509.NewCertPool()
+			for _, r := range raw[1:] {
+				if ic, err := x509.ParseCertificate(r); err == nil {
+					inter.AddCert(ic)
+				}
+			}
+			_, err := leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: inter,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			return err
+		}
+	} else {
+		pinned, err = loadPins(filepath.Join(c.Dir, knownPeersFile))
+		if err != nil {
+			return nil, err
+		}
+		// The node checks the pins itself once it knows the ID of
+		// the peer; see Node.checkPin.
+		verify = func(*x509.Certificate, [][]byte) error { return nil }
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Peers are known by address, not by a name their certificate
+		// could be checked against, so both sides verify the peer's
+		// certificate themselves.
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("peer sent no certificate")
+			}
+			leaf, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			return verify(leaf, raw)
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+	if pinned != nil {
+		tofu.Store(cfg, pinned)
+	}
+	return cfg, nil
+}
+
+// tofu holds the pins of the configs returned by NewTLSConfig that trust
+// peers on first use.
+var tofu sync.Map // *tls.Config → *pins
+
+// handshakeTimeout bounds the TLS handshake on a new connection, so that a
+// peer can't hold one open without completing it.
+const handshakeTimeout = 10 * time.Second
+
+// secure runs the TLS handshake on c, as the client if the node dialled it,
+// and returns the encrypted connection.
+func (n *Node) secure(c net.Conn, client bool) (net.Conn, error) {
+	var tc *tls.Conn
+	if client {
+		tc = tls.Client(c, n.cfg.TLS)
+	} else {
+		tc = tls.Server(c, n.cfg.TLS)
+	}
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// checkPin checks the certificate presented by the peer on c against the one
+// pinned for id, the node ID the peer sent in its hello or welcome, and pins
+// it if id is new. It accepts any certificate unless the node trusts peers on
+// first use.
+func (n *Node) checkPin(c net.Conn, id string) error {
+	tc, ok := c.(*tls.Conn)
+	if !ok || n.pins == nil {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("peer sent no certificate")
+	}
+	return n.pins.check(id, certs[0].Raw)
+}
+
+// awaitWelcome sends hello on a connection the node dialled and returns the
+// acceptor's welcome, which tells the ID of the peer.
+func (n *Node) awaitWelcome(c net.Conn, d *frameDecoder, e *outStream, hello Message) (Message, error) {
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	if err := e.Encode(hello); err != nil {
+		return Message{}, err
+	}
+	if err := e.Flush(); err != nil {
+		return Message{}, err
+	}
+	var w Message
+	if err := decodeValid(d, &w); err != nil {
+		return Message{}, err
+	}
+	if w.Kind != KindWelcome {
+		return Message{}, errors.New("expected a welcome")
+	}
+	return w, nil
+}
+
+// peerName returns the common name of the certificate presented by the peer
+// on c, or "" if c doesn't use TLS.
+func peerName(c net.Conn) string {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// generateCert writes a new self-signed certificate and its key, with a
+// random common name, to the given files.
+func generateCert(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gopher-" + util.RandomID()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// pins maps the node IDs of known peers to the SHA-256 fingerprints of their
+// certificates, and mirrors them in a file.
+type pins struct {
+	mu   sync.Mutex
+	path string
+	m    map[string]string
+}
+
+// loadPins reads the pins in the file at path, if it exists.
+// Each line holds a node ID and a fingerprint in hex.
+func loadPins(path string) (*pins, error) {
+	p := &pins{path: path, m: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		p.m[fields[0]] = fields[1]
+	}
+	return p, s.Err()
+}
+
+// check accepts the certificate raw presented by the peer with the given
+// node ID if its fingerprint matches the pinned one, pinning it if id is new.
+func (p *pins) check(id string, raw []byte) error {
+	if !validHex(id, idLen) {
+		return fmt.Errorf("bad node ID %q to pin a certificate to", id)
+	}
+	sum := sha256.Sum256(raw)
+	fp := hex.EncodeToString(sum[:])
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pinned, ok := p.m[id]
+	if ok {
+		if pinned != fp {
+			return fmt.Errorf("certificate for node %v does not match the one pinned in %v", id, p.path)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, id, fp)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	p.m[id] = fp
+	return nil
+}
@@ -0,0 +1,276 @@
+package peer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTLS(t *testing.T, c TLSConfig) *tls.Config {
+	cfg, err := NewTLSConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// handshake runs a TLS handshake between client and server over a loopback
+// connection and returns the error seen by the server, or else by the client.
+func handshake(t *testing.T, client, server *tls.Config) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		done <- tls.Server(c, server).Handshake()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cerr := tls.Client(c, client).Handshake()
+	if cerr != nil {
+		c.Close()
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	return cerr
+}
+
+func TestTLSMesh(t *testing.T) {
+	const n = 3
+	delivered := make(chan int, n)
+	nodes := make([]*Node, n)
+	dirs := make([]string, n)
+	for i := range nodes {
+		dirs[i] = t.TempDir()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		i := i
+		nodes[i] = New(l, Config{
+			TLS:     newTestTLS(t, TLSConfig{Dir: dirs[i]}),
+			Deliver: func(Message) { delivered <- i },
+		})
+		go nodes[i].Serve()
+	}
+	for _, a := range nodes {
+		for _, b := range nodes {
+			go a.Dial(b.Addr())
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, a := range nodes {
+		for a.Peers().Len() < n-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v connected to %d peers, want %d", a.Addr(), a.Peers().Len(), n-1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	nodes[0].Send("hello")
+	waitDelivered(t, n, delivered, 5*time.Second)
+
+	b, err := os.ReadFile(filepath.Join(dirs[0], knownPeersFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != n-1 {
+		t.Errorf("pinned %d peers, want %d:\n%s", got, n-1, b)
+	}
+}
+
+func TestTLSPinMismatch(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestNode(t, Config{TLS: newTestTLS(t, TLSConfig{Dir: dir})})
+	b := newTestTLS(t, TLSConfig{Dir: t.TempDir()})
+	// connect returns a connection from a to a peer using server.
+	connect := func(server *tls.Config) net.Conn {
+		c, s := net.Pipe()
+		t.Cleanup(func() { c.Close(); s.Close() })
+		go tls.Server(s, server).Handshake()
+		tc, err := a.secure(c, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tc
+	}
+	const id = "0123456789abcdef" // ID of b
+	if err := a.checkPin(connect(b), id); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	if err := a.checkPin(connect(b), id); err != nil {
+		t.Fatalf("second connection: %v", err)
+	}
+
+	// Another peer claiming the ID of b is rejected, even if it uses the
+	// common name of b.
+	leaf, err := x509.ParseCertificate(b.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirC := t.TempDir()
+	writeCert(t, dirC, leaf.Subject.CommonName, nil, nil)
+	c := newTestTLS(t, TLSConfig{Dir: dirC})
+	if err := a.checkPin(connect(c), id); err == nil {
+		t.Error("connection to an impostor succeeded")
+	}
+	if err := a.checkPin(connect(c), "fedcba9876543210"); err != nil {
+		t.Errorf("connection to a new node: %v", err)
+	}
+	if err := a.checkPin(connect(c), "10.0.0.2:4000"); err == nil {
+		t.Error("pinned a certificate to something other than a node ID")
+	}
+
+	// The pins survive a restart.
+	p, err := loadPins(filepath.Join(dir, knownPeersFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.m) != 2 {
+		t.Errorf("reloaded %d pins, want 2: %v", len(p.m), p.m)
+	}
+	if err := p.check(id, c.Certificates[0].Certificate[0]); err == nil {
+		t.Error("reloaded pins accepted an impostor")
+	}
+}
+
+func TestTLSPinRestart(t *testing.T) {
+	dir := t.TempDir()
+	var delivered int32
+	a := newTestNode(t, Config{
+		TLS:     newTestTLS(t, TLSConfig{Dir: dir}),
+		Deliver: func(Message) { atomic.AddInt32(&delivered, 1) },
+	})
+	// b restarts on a new address, with the same ID and certificate.
+	dirB := t.TempDir()
+	for i := 0; i < 2; i++ {
+		b := newTestNode(t, Config{ID: "0123456789abcdef", TLS: newTestTLS(t, TLSConfig{Dir: dirB})})
+		go b.Dial(a.Addr())
+		atomic.StoreInt32(&delivered, 0)
+		waitFor(t, 5*time.Second, fmt.Sprintf("a message from b after %d restarts", i), func() bool {
+			b.Send("hello")
+			return atomic.LoadInt32(&delivered) > 0
+		})
+		b.Close()
+	}
+	p, err := loadPins(filepath.Join(dir, knownPeersFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.m) != 1 {
+		t.Errorf("pinned %d certificates, want 1: %v", len(p.m), p.m)
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(name string) *tls.Config {
+		d := filepath.Join(dir, name)
+		writeCert(t, d, name, ca, caKey)
+		return newTestTLS(t, TLSConfig{
+			CertFile: filepath.Join(d, certFile),
+			KeyFile:  filepath.Join(d, keyFile),
+			CAFile:   caFile,
+		})
+	}
+	a, b := signed("a"), signed("b")
+	if err := handshake(t, a, b); err != nil {
+		t.Fatalf("handshake between signed peers: %v", err)
+	}
+
+	self := newTestTLS(t, TLSConfig{Dir: t.TempDir()})
+	if err := handshake(t, self, b); err == nil {
+		t.Error("server accepted a self-signed client")
+	}
+	if err := handshake(t, a, self); err == nil {
+		t.Error("client accepted a self-signed server")
+	}
+}
+
+// writeCert writes a certificate with the given common name to dir, signed
+// by parent, or self-signed if parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for file, b := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatalf("writing %v: %v", file, err)
+		}
+	}
+}
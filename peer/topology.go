@@ -0,0 +1,147 @@
+package peer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// Topology queries.
+//
+// A node answers a topology message received on an accepted connection,
+// without a hello, with a neighbours message whose Links describe its
+// connections. QueryTopology sends the query; the meshmap command uses it to
+// crawl the mesh from a seed and draw its graph. Nodes on a network with a
+// key or TLS only answer programs that can connect to them.
+
+// maxLinks bounds the entries of Message.Links.
+const maxLinks = 1024
+
+// Link describes a connection between a node and a peer.
+type Link struct {
+	Addr string        // listen address of the peer
+	Dir  string        // util.DirOut if the node dialled the peer, util.DirIn if it accepted the connection
+	Age  time.Duration // time since the connection was established
+}
+
+// Field tags of a Link in the binary codec.
+const (
+	linkTagAddr = iota + 1
+	linkTagDir
+	linkTagAge
+)
+
+// Links returns the node's connections to and from its peers, sorted by
+// address and direction.
+func (n *Node) Links() []Link {
+	now := n.cfg.Clock.Now()
+	var l []Link
+	for _, p := range n.peers.Info() {
+		if p.Connected {
+			l = append(l, Link{Addr: p.Addr, Dir: util.DirOut, Age: now.Sub(p.Since)})
+		}
+	}
+	n.mu.Lock()
+	for _, in := range n.inbound {
+		l = append(l, Link{Addr: in.addr, Dir: util.DirIn, Age: now.Sub(in.since)})
+	}
+	n.mu.Unlock()
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Addr != l[j].Addr {
+			return l[i].Addr < l[j].Addr
+		}
+		return l[i].Dir > l[j].Dir
+	})
+	if len(l) > maxLinks {
+		l = l[:maxLinks]
+	}
+	return l
+}
+
+// neighbours returns the answer to a topology query.
+func (n *Node) neighbours() Message {
+	return Message{Kind: KindNeighbours, Addr: n.self, Nick: n.Nick(), From: n.id, Links: n.Links()}
+}
+
+// QueryTopology asks the node at addr for its neighbours, over t, and returns
+// its answer, whose Links list them. It gives up after timeout.
+func QueryTopology(t transport.Transport, addr string, timeout time.Duration) (Message, error) {
+	c, err := t.Dial(addr)
+	if err != nil {
+		return Message{}, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	q := Message{Kind: KindTopology, Addr: c.LocalAddr().String()}
+	if err := json.NewEncoder(c).Encode(q); err != nil {
+		return Message{}, err
+	}
+	var m Message
+	err = newFrameDecoder(c, defaultMaxFrame).Decode(&m)
+	if err == nil {
+		err = m.validate()
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	if m.Kind != KindNeighbours {
+		return Message{}, fmt.Errorf("%s answered with a %q message", addr, m.Kind)
+	}
+	return m, nil
+}
+
+// validate checks a link received from a peer.
+func (l *Link) validate() error {
+	switch {
+	case !validAddr(l.Addr):
+		return &invalidError{"Links.Addr", strconv.Quote(l.Addr)}
+	case l.Dir != util.DirIn && l.Dir != util.DirOut:
+		return &invalidError{"Links.Dir", strconv.Quote(l.Dir)}
+	case l.Age < 0:
+		return &invalidError{"Links.Age", l.Age.String()}
+	}
+	return nil
+}
+
+// appendBinary appends the nested binary payload of l to b.
+func (l *Link) appendBinary(b []byte) []byte {
+	b = appendString(b, linkTagAddr, l.Addr)
+	b = appendString(b, linkTagDir, l.Dir)
+	return appendUint(b, linkTagAge, uint64(l.Age))
+}
+
+// unmarshalBinary decodes the nested payload of a Link into l.
+func (l *Link) unmarshalBinary(b []byte) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBadPayload
+		}
+		b = b[n:]
+		ok := true
+		switch tag {
+		case linkTagAddr:
+			l.Addr, b, ok = readBytes(b)
+		case linkTagDir:
+			l.Dir, b, ok = readBytes(b)
+		case linkTagAge:
+			v, n := binary.Uvarint(b)
+			if ok = n > 0; ok {
+				b = b[n:]
+				l.Age = time.Duration(v)
+			}
+		default:
+			return &invalidError{"binary message", fmt.Sprintf("unknown link field %d", tag)}
+		}
+		if !ok {
+			return errBadPayload
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/campoy/whispering-gophers/transport"
+)
+
+func TestQueryTopology(t *testing.T) {
+	nodes, _ := startMesh(t, 3, Config{})
+	nodes[0].SetNick("gopher0")
+	a, b := nodes[1].Addr(), nodes[2].Addr()
+	if a > b {
+		a, b = b, a
+	}
+	want := fmt.Sprintf("[%[1]s out %[1]s in %[2]s out %[2]s in]", a, b)
+	waitFor(t, 5*time.Second, "the links of "+nodes[0].Addr(), func() bool {
+		m, err := QueryTopology(transport.TCP, nodes[0].Addr(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Addr != nodes[0].Addr() || m.Nick != "gopher0" || m.From != nodes[0].ID() {
+			t.Fatalf("answer from %s (%s, %s), want %s (gopher0, %s)", m.Addr, m.Nick, m.From, nodes[0].Addr(), nodes[0].ID())
+		}
+		var s []string
+		for _, l := range m.Links {
+			s = append(s, l.Addr+" "+l.Dir)
+		}
+		return fmt.Sprint(s) == want
+	})
+}
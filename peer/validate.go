@@ -0,0 +1,242 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the fields of a Message.
+const (
+	idLen    = 16   // length of an ID made by util.RandomID
+	nonceLen = 32   // length of a nonce made by newNonce
+	macLen   = 64   // length of a MAC made by sign
+	maxIDs   = 1024 // entries in Message.IDs
+	maxNick  = 32   // runes in Message.Nick
+	maxVia   = 16   // entries in Message.Via
+)
+
+// invalidError describes a message that was decoded but is not valid.
+type invalidError struct {
+	field, reason string
+}
+
+func (e *invalidError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.field, e.reason)
+}
+
+// recoverable reports whether the decoder can carry on with the next message
+// after err: the bad message was read in full, but it was malformed or didn't
+// fit the schema.
+func recoverable(err error) bool {
+	switch err.(type) {
+	case *invalidError, *json.UnmarshalTypeError, *json.SyntaxError:
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "json: unknown field")
+}
+
+// validate checks the fields of a message received from a peer.
+func (m *Message) validate() error {
+	switch m.Kind {
+	case "", KindHello, KindWelcome, KindChallenge, KindAck, KindDigest, KindPull, KindIHave, KindGraft, KindPrune,
+		KindTopology, KindNeighbours, KindPing, KindPong, KindFindNode, KindNodes:
+	default:
+		return &invalidError{"Kind", strconv.Quote(m.Kind)}
+	}
+	if m.ID != "" && !validHex(m.ID, idLen) {
+		return &invalidError{"ID", strconv.Quote(m.ID)}
+	}
+	if (m.Kind == KindPing || m.Kind == KindPong) && m.ID == "" {
+		return &invalidError{"ID", "missing in a " + m.Kind}
+	}
+	if m.From != "" && !validHex(m.From, idLen) {
+		return &invalidError{"From", strconv.Quote(m.From)}
+	}
+	// Chat messages from the early parts of the code lab have no Addr,
+	// but every control message must say who sent it.
+	if (m.Addr != "" || m.Kind != "") && !validAddr(m.Addr) {
+		return &invalidError{"Addr", strconv.Quote(m.Addr)}
+	}
+	if len(m.IDs) > maxIDs {
+		return &invalidError{"IDs", fmt.Sprintf("%d entries", len(m.IDs))}
+	}
+	for _, id := range m.IDs {
+		if !validHex(id, idLen) {
+			return &invalidError{"IDs", strconv.Quote(id)}
+		}
+	}
+	if len(m.Via) > maxVia {
+		return &invalidError{"Via", fmt.Sprintf("%d entries", len(m.Via))}
+	}
+	if m.Via != nil && m.Kind != "" {
+		return &invalidError{"Via", "not in a chat message"}
+	}
+	if m.Urgent && m.Kind != "" {
+		return &invalidError{"Urgent", "not in a chat message"}
+	}
+	for _, id := range m.Via {
+		if !validHex(id, idLen) {
+			return &invalidError{"Via", strconv.Quote(id)}
+		}
+	}
+	for addr := range m.Clock {
+		if !validAddr(addr) {
+			return &invalidError{"Clock", strconv.Quote(addr)}
+		}
+	}
+	if m.To != "" && !validAddr(m.To) {
+		return &invalidError{"To", strconv.Quote(m.To)}
+	}
+	if m.Target != "" && !validHex(m.Target, idLen) {
+		return &invalidError{"Target", strconv.Quote(m.Target)}
+	}
+	switch {
+	case m.Kind == KindFindNode && m.Target == "":
+		return &invalidError{"Target", "missing in a " + m.Kind}
+	case m.Target == "" || m.Kind == KindFindNode || m.Kind == KindNodes:
+	case m.Kind != "" || m.To != "" || m.File != nil || m.Presence != "":
+		return &invalidError{"Target", "not in a direct chat message"}
+	}
+	if m.Contacts != nil && m.Kind != KindNodes {
+		return &invalidError{"Contacts", "not in a nodes message"}
+	}
+	if len(m.Contacts) > dhtK {
+		return &invalidError{"Contacts", fmt.Sprintf("%d entries", len(m.Contacts))}
+	}
+	for i := range m.Contacts {
+		if err := m.Contacts[i].validate(); err != nil {
+			return err
+		}
+	}
+	if !validNick(m.Nick) {
+		return &invalidError{"Nick", strconv.Quote(m.Nick)}
+	}
+	switch m.Codec {
+	case "", CodecJSON, CodecBinary:
+	default:
+		return &invalidError{"Codec", strconv.Quote(m.Codec)}
+	}
+	if m.Compress != "" && m.Compress != CompressFlate {
+		return &invalidError{"Compress", strconv.Quote(m.Compress)}
+	}
+	if m.Nonce != "" && !validHex(m.Nonce, nonceLen) {
+		return &invalidError{"Nonce", strconv.Quote(m.Nonce)}
+	}
+	if m.MAC != "" && !validHex(m.MAC, macLen) {
+		return &invalidError{"MAC", strconv.Quote(m.MAC)}
+	}
+	switch m.Presence {
+	case "":
+	case PresenceJoin, PresenceAlive, PresenceLeave:
+		if m.Kind != "" || m.To != "" || m.File != nil || m.Body != "" {
+			return &invalidError{"Presence", "not in an empty chat message"}
+		}
+	default:
+		return &invalidError{"Presence", strconv.Quote(m.Presence)}
+	}
+	if m.Links != nil && m.Kind != KindNeighbours {
+		return &invalidError{"Links", "not in a neighbours message"}
+	}
+	if len(m.Links) > maxLinks {
+		return &invalidError{"Links", fmt.Sprintf("%d entries", len(m.Links))}
+	}
+	for i := range m.Links {
+		if err := m.Links[i].validate(); err != nil {
+			return err
+		}
+	}
+	if m.File != nil {
+		if m.Kind != "" || m.To != "" {
+			return &invalidError{"File", "not in a chat message"}
+		}
+		return m.File.validate()
+	}
+	return nil
+}
+
+// validate checks the description of a file chunk. The chunk's data is
+// checked by chunkData.
+func (f *FileChunk) validate() error {
+	switch {
+	case !validFileName(f.Name):
+		return &invalidError{"File.Name", strconv.Quote(f.Name)}
+	case f.Size <= 0 || f.Size > maxFileSize:
+		return &invalidError{"File.Size", strconv.FormatInt(f.Size, 10)}
+	case !validHex(f.Sum, hashLen):
+		return &invalidError{"File.Sum", strconv.Quote(f.Sum)}
+	case int64(f.Chunks) != (f.Size+chunkSize-1)/chunkSize:
+		return &invalidError{"File.Chunks", strconv.Itoa(f.Chunks)}
+	case f.Index < 0 || f.Index >= f.Chunks:
+		return &invalidError{"File.Index", strconv.Itoa(f.Index)}
+	case !validHex(f.ChunkSum, hashLen):
+		return &invalidError{"File.ChunkSum", strconv.Quote(f.ChunkSum)}
+	case len(f.Proof) > maxProof:
+		return &invalidError{"File.Proof", fmt.Sprintf("%d hashes", len(f.Proof))}
+	}
+	for _, h := range f.Proof {
+		if !validHex(h, hashLen) {
+			return &invalidError{"File.Proof", strconv.Quote(h)}
+		}
+	}
+	return nil
+}
+
+// validHex reports whether s is made of n lowercase hex digits, like the IDs
+// made by util.RandomID.
+func validHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validAddr reports whether addr is a host:port pair with a numeric port, or
+// an IP address without a port, as handed out by the proxy package.
+func validAddr(addr string) bool {
+	if net.ParseIP(addr) != nil {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && 0 < p && p < 1<<16
+}
+
+// validNick reports whether nick is short and printable.
+func validNick(nick string) bool {
+	if utf8.RuneCountInString(nick) > maxNick || !utf8.ValidString(nick) {
+		return false
+	}
+	for _, r := range nick {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFileName reports whether name can be used as is for a file in the
+// download directory: a short, printable base name that isn't hidden.
+func validFileName(name string) bool {
+	if name == "" || len(name) > 255 || name[0] == '.' || strings.ContainsAny(name, `/\:`) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return utf8.ValidString(name)
+}
@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	const id, addr = "0123456789abcdef", "10.0.0.1:4000"
+	sum := strings.Repeat("0f", 32)
+	tests := []struct {
+		m  Message
+		ok bool
+	}{
+		{Message{ID: id, Addr: addr, Body: "hi"}, true},
+		{Message{Body: "from part 4"}, true},
+		{Message{Kind: KindDigest, Addr: addr, IDs: []string{id}}, true},
+		{Message{ID: id, Addr: addr, Clock: map[string]uint64{addr: 1}}, true},
+		{Message{ID: "xyz", Addr: addr}, false},
+		{Message{ID: strings.ToUpper(id), Addr: addr}, false},
+		{Message{ID: id, Addr: "10.0.0.1"}, true}, // from the proxy
+		{Message{ID: id, Addr: "gopher"}, false},
+		{Message{ID: id, Addr: "10.0.0.1:http"}, false},
+		{Message{ID: id, Addr: ":4000"}, false},
+		{Message{Kind: KindDigest}, false},
+		{Message{Kind: "bogus", Addr: addr}, false},
+		{Message{Kind: KindPull, Addr: addr, IDs: []string{"nope"}}, false},
+		{Message{ID: id, Addr: addr, Clock: map[string]uint64{"nope": 1}}, false},
+		{Message{ID: id, Addr: addr, To: "nope"}, false},
+		{Message{ID: id, Addr: addr, Nick: "bad\x1b[2J"}, false},
+		{Message{ID: id, Addr: addr, Nick: strings.Repeat("x", maxNick+1)}, false},
+		{testChunk, true},
+		{Message{ID: id, Addr: addr, Presence: PresenceJoin}, true},
+		{Message{ID: id, Addr: addr, From: id}, true},
+		{Message{ID: id, Addr: addr, From: "gopher"}, false},
+		{Message{ID: id, Addr: addr, Presence: "away"}, false},
+		{Message{ID: id, Addr: addr, Body: "hi", Presence: PresenceAlive}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: "../passwd", Size: 1, Sum: sum, Chunks: 1, ChunkSum: sum}}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: ".bashrc", Size: 1, Sum: sum, Chunks: 1, ChunkSum: sum}}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: "a", Size: chunkSize + 1, Sum: sum, Chunks: 1, ChunkSum: sum}}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: "a", Size: 1, Sum: sum, Chunks: 1, Index: 1, ChunkSum: sum}}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: "a", Size: 1, Sum: sum, Chunks: 1, ChunkSum: sum, Proof: []string{"gopher"}}}, false},
+		{Message{ID: id, Addr: addr, File: &FileChunk{Name: "a", Size: 1, Sum: sum, Chunks: 1, ChunkSum: sum, Proof: make([]string, maxProof+1)}}, false},
+		{Message{Kind: KindPull, Addr: addr, File: testChunk.File}, false},
+		{Message{ID: id, Addr: addr, Via: []string{id, id}}, true},
+		{Message{ID: id, Addr: addr, Via: []string{"gopher"}}, false},
+		{Message{ID: id, Addr: addr, Via: make([]string, maxVia+1)}, false},
+		{Message{Kind: KindPull, Addr: addr, Via: []string{id}}, false},
+		{Message{ID: id, Addr: addr, Body: "hi", Urgent: true}, true},
+		{Message{Kind: KindPull, Addr: addr, Urgent: true}, false},
+		{testNeighbours, true},
+		{Message{ID: id, Addr: addr, Links: testNeighbours.Links}, false},
+		{testNodes, true},
+		{Message{ID: id, Addr: addr, Body: "hi", Target: id}, true},
+		{Message{ID: id, Addr: addr, Body: "hi", Target: "gopher"}, false},
+		{Message{ID: id, Addr: addr, Body: "hi", Target: id, To: addr}, false},
+		{Message{Kind: KindFindNode, Addr: addr}, false},
+		{Message{Kind: KindPull, Addr: addr, Target: id}, false},
+		{Message{ID: id, Addr: addr, Contacts: testNodes.Contacts}, false},
+		{Message{Kind: KindNodes, Addr: addr, Contacts: []Contact{{ID: id, Addr: "nope"}}}, false},
+		{Message{Kind: KindNodes, Addr: addr, Contacts: make([]Contact, dhtK+1)}, false},
+	}
+	for _, tt := range tests {
+		err := tt.m.validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok = %v", tt.m, err, tt.ok)
+		}
+	}
+}
+
+// expectClosed fails the test unless the node closes c within a few seconds.
+func expectClosed(t *testing.T, c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestOversizedFrame(t *testing.T) {
+	n := newTestNode(t, Config{MaxFrame: 1024})
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go fmt.Fprintf(c, `{"Body": "%s"}`, strings.Repeat("x", 1<<20))
+	expectClosed(t, c)
+	if s := n.Stats(); s.BadFrames != 1 {
+		t.Errorf("Stats().BadFrames = %d, want 1", s.BadFrames)
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	n := newTestNode(t, Config{MaxBadFrames: 3})
+	c, err := net.Dial("tcp", n.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Messages that don't fit the schema are skipped...
+	fmt.Fprintln(c, `{"Body": "a", "Extra": 1}`)
+	fmt.Fprintln(c, `{"ID": 42}`)
+	// ...valid ones still get through...
+	fmt.Fprintln(c, `{"Body": "b"}`)
+	// ...until there have been too many.
+	fmt.Fprintln(c, `{"Addr": "nowhere"}`)
+	expectClosed(t, c)
+	if s := n.Stats(); s.BadFrames != 3 || s.Received != 1 {
+		t.Errorf("BadFrames, Received = %d, %d; want 3, 1", s.BadFrames, s.Received)
+	}
+}
@@ -11,7 +11,7 @@ package proxy
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 )
 
@@ -133,7 +133,7 @@ type logConn struct {
 func (c logConn) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
 	if verbose {
-		log.Printf("%v wr %q (%v)", c.prefix, b, err)
+		slog.Debug("proxy write", "conn", c.prefix, "data", string(b), "err", err)
 	}
 	return
 }
@@ -141,7 +141,7 @@ func (c logConn) Write(b []byte) (n int, err error) {
 func (c logConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
 	if verbose {
-		log.Printf("%v rd %q (%v)", c.prefix, b[:n], err)
+		slog.Debug("proxy read", "conn", c.prefix, "data", string(b[:n]), "err", err)
 	}
 	return
 }
@@ -149,7 +149,7 @@ func (c logConn) Read(b []byte) (n int, err error) {
 func (c logConn) Close() (err error) {
 	err = c.Conn.Close()
 	if verbose {
-		log.Printf("%v cl (%v)", c.prefix, err)
+		slog.Debug("proxy close", "conn", c.prefix, "err", err)
 	}
 	return
 }
@@ -8,22 +8,40 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"strings"
 	"sync"
+
+	"github.com/campoy/whispering-gophers/util"
 )
 
 var (
 	listenAddr = flag.String("addr", "localhost:2000", "listen address")
 	testMode   = flag.Bool("test", false, "print listen address (for integration test)")
+	logLevel   = flag.String("log-level", "info", "lowest level of the logs shown: "+strings.Join(util.LogLevels, ", "))
+	logFormat  = flag.String("log-format", "text", "format of the logs: "+strings.Join(util.LogFormats, " or "))
 )
 
 func main() {
 	flag.Parse()
 
+	level, err := util.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lg, err := util.NewLogger(os.Stderr, level, *logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(lg)
+
 	s := NewServer()
 	l, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
-		log.Fatal(err)
+		lg.Error("listening failed", util.LogErr, err)
+		os.Exit(1)
 	}
 	if *testMode {
 		fmt.Println(l.Addr())
@@ -31,7 +49,8 @@ func main() {
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			log.Fatal(err)
+			lg.Error("accepting failed", util.LogErr, err)
+			os.Exit(1)
 		}
 		go s.Serve(c)
 	}
@@ -57,7 +76,7 @@ func (s *Server) Serve(c net.Conn) {
 	var cmd, arg string
 	_, err := fmt.Fscan(c, &cmd, &arg)
 	if err != nil {
-		log.Println("%v: bad command:", c.RemoteAddr(), err)
+		slog.Warn("bad command", util.LogPeer, c.RemoteAddr(), util.LogErr, err)
 		c.Close()
 		return
 	}
@@ -71,7 +90,7 @@ func (s *Server) Serve(c net.Conn) {
 	case "DIAL":
 		s.Dial(c, arg)
 	default:
-		log.Println("%v: bad command:", c.RemoteAddr(), cmd)
+		slog.Warn("bad command", util.LogPeer, c.RemoteAddr(), "cmd", cmd)
 		c.Close()
 	}
 }
@@ -131,7 +150,7 @@ func (s *Server) Accept(c net.Conn, key string) {
 	go cp(errc, c, c2)
 	go cp(errc, c2, c)
 	if err := <-errc; err != nil {
-		log.Println(err)
+		slog.Info("copy failed", util.LogErr, err)
 	}
 }
 
@@ -20,14 +20,18 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
+	"github.com/campoy/whispering-gophers/transport"
 	"github.com/campoy/whispering-gophers/util"
 )
 
 var (
-	peerAddr = flag.String("peer", "", "peer host:port")
-	self     string
+	peerAddr  = flag.String("peer", "", "peer host:port")
+	transName = flag.String("transport", "tcp", "how to reach peers: "+strings.Join(transport.Remote, ", "))
+	tr        transport.Transport
+	self      string
 )
 
 type Message struct {
@@ -39,7 +43,12 @@ type Message struct {
 func main() {
 	flag.Parse()
 
-	l, err := util.Listen()
+	var err error
+	tr, err = transport.NewRemote(*transName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := tr.Listen()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -152,7 +161,7 @@ func dial(addr string) {
 	}
 	defer peers.Remove(addr)
 
-	c, err := net.Dial("tcp", addr)
+	c, err := tr.Dial(addr)
 	if err != nil {
 		log.Println(addr, err)
 		return
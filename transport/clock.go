@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and runs timers. Nodes and in-memory networks use
+// one, so that tests can replace the real clock with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has passed.
+	AfterFunc(d time.Duration, f func()) Timer
+	// Tick returns a channel that delivers the time every d, dropping
+	// ticks for slow receivers, like time.Tick.
+	Tick(d time.Duration) <-chan time.Time
+}
+
+// A Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the clock of the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+func (realClock) Tick(d time.Duration) <-chan time.Time     { return time.Tick(d) }
+
+// FakeClock is a Clock that only moves when told to. Its timers fire during
+// calls to Advance, in order.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // sorted by when
+}
+
+// NewFakeClock returns a FakeClock set to a fixed time.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2013, 5, 15, 9, 0, 0, 0, time.UTC)}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, firing the timers due on the way.
+// Callbacks passed to AfterFunc run synchronously, before Advance moves on
+// to the next timer.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			c.insert(t)
+		}
+		now := c.now
+		c.mu.Unlock()
+		t.fire(now)
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{c: c, fire: func(time.Time) { f() }}
+	t.Reset(d)
+	return t
+}
+
+func (c *FakeClock) Tick(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	t := &fakeTimer{c: c, period: d, fire: func(now time.Time) {
+		select {
+		case ch <- now:
+		default:
+		}
+	}}
+	t.Reset(d)
+	return ch
+}
+
+// insert adds t to the timers. The caller must hold c.mu.
+func (c *FakeClock) insert(t *fakeTimer) {
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].when.After(t.when) })
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+}
+
+// remove removes t from the timers, reporting whether it was there.
+// The caller must hold c.mu.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	c      *FakeClock
+	when   time.Time
+	period time.Duration
+	fire   func(now time.Time)
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	active := t.c.remove(t)
+	t.when = t.c.now.Add(d)
+	t.c.insert(t)
+	return active
+}
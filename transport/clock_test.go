@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock()
+	start := c.Now()
+	var fired []string
+	c.AfterFunc(30*time.Millisecond, func() { fired = append(fired, "b") })
+	c.AfterFunc(10*time.Millisecond, func() { fired = append(fired, "a") })
+	stopped := c.AfterFunc(20*time.Millisecond, func() { fired = append(fired, "stopped") })
+	tick := c.Tick(25 * time.Millisecond)
+
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	c.Advance(20 * time.Millisecond)
+	if want := []string{"a"}; !reflect.DeepEqual(fired, want) {
+		t.Errorf("after 20ms fired %q, want %q", fired, want)
+	}
+	select {
+	case <-tick:
+		t.Error("ticked after 20ms")
+	default:
+	}
+
+	c.Advance(20 * time.Millisecond)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(fired, want) {
+		t.Errorf("after 40ms fired %q, want %q", fired, want)
+	}
+	select {
+	case now := <-tick:
+		if got := now.Sub(start); got != 25*time.Millisecond {
+			t.Errorf("ticked at %v, want 25ms", got)
+		}
+	default:
+		t.Error("no tick after 40ms")
+	}
+	if got := c.Now().Sub(start); got != 40*time.Millisecond {
+		t.Errorf("clock moved %v, want 40ms", got)
+	}
+}
@@ -0,0 +1,415 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memory is a network inside a process, for running and testing many nodes
+// at once. Its hosts have addresses of the form "mem:N".
+//
+// Each Write on a connection is a packet, delivered to the other end once
+// the network's latency has passed on its clock, unless it is lost or the
+// two hosts are partitioned. Lost packets vanish without an error, so only
+// messages written whole in a single Write, as the JSON and binary codecs
+// do, survive loss intact; compressed and TLS streams don't.
+type Memory struct {
+	clock   Clock
+	pending int64 // packets in flight
+	arrived int64 // packets that reached their reader but weren't read
+	reads   chan struct{}
+
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	last      int // port of the last address handed out
+	latency   time.Duration
+	loss      float64
+	seed      int64
+	group     map[string]int // partition of each host, if any
+}
+
+// NewMemory returns a new, empty in-memory network with no latency, loss or
+// partitions, running on the real clock.
+func NewMemory() *Memory {
+	return NewMemoryClock(RealClock)
+}
+
+// NewMemoryClock is like NewMemory, but the network delivers packets by the
+// given clock.
+func NewMemoryClock(c Clock) *Memory {
+	return &Memory{clock: c, reads: make(chan struct{}, 1), listeners: make(map[string]*memListener)}
+}
+
+// Clock returns the clock of the network.
+func (m *Memory) Clock() Clock { return m.clock }
+
+// SetLatency sets the delay of packets written from now on.
+func (m *Memory) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	m.latency = d
+	m.mu.Unlock()
+}
+
+// SetLoss sets the probability that a packet is lost. Whether each packet
+// is lost is decided by a random source for its connection, seeded from
+// seed and the addresses of its ends, so a test that writes the same
+// packets on the same connections loses the same ones.
+func (m *Memory) SetLoss(p float64, seed int64) {
+	m.mu.Lock()
+	m.loss, m.seed = p, seed
+	m.mu.Unlock()
+}
+
+// Partition splits the given groups of host addresses from each other:
+// packets between hosts in different groups are lost, and dials between them
+// fail. Hosts in no group can reach everyone. It replaces any earlier
+// partition.
+func (m *Memory) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.group = make(map[string]int)
+	for i, g := range groups {
+		for _, addr := range g {
+			m.group[addr] = i
+		}
+	}
+}
+
+// Heal removes any partition.
+func (m *Memory) Heal() { m.Partition() }
+
+// Pending returns the number of packets written but not yet read.
+func (m *Memory) Pending() int { return int(atomic.LoadInt64(&m.pending)) }
+
+// Settle waits until the packets that have arrived by the network's clock
+// have been read. Tests on a FakeClock call it after Advance to let the
+// readers catch up before moving the clock on.
+func (m *Memory) Settle() {
+	for atomic.LoadInt64(&m.arrived) > 0 {
+		<-m.reads
+	}
+}
+
+// read records that an arrived packet has been read or dropped.
+func (m *Memory) read() {
+	atomic.AddInt64(&m.arrived, -1)
+	select {
+	case m.reads <- struct{}{}:
+	default:
+	}
+}
+
+// cut reports whether packets between hosts a and b are lost to a partition.
+func (m *Memory) cut(a, b string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ga, oka := m.group[a]
+	gb, okb := m.group[b]
+	return oka && okb && ga != gb
+}
+
+// Host returns a new host on the network. Nodes should each use their own
+// host, so that partitions can tell them apart.
+func (m *Memory) Host() *Host {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last++
+	return &Host{m: m, addr: memAddr(fmt.Sprintf("mem:%d", m.last))}
+}
+
+// Listen listens at the address of a new host.
+func (m *Memory) Listen() (net.Listener, error) { return m.Host().Listen() }
+
+// Dial connects to the listener at addr from a new host.
+func (m *Memory) Dial(addr string) (net.Conn, error) { return m.Host().Dial(addr) }
+
+// A Host is an address on a Memory network, and a Transport whose
+// connections come from that address.
+type Host struct {
+	m    *Memory
+	addr memAddr
+}
+
+// Addr returns the address of the host.
+func (h *Host) Addr() string { return string(h.addr) }
+
+// Listen listens at the address of the host. A host has one listener at a
+// time.
+func (h *Host) Listen() (net.Listener, error) {
+	m := h.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[h.Addr()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: h.addr, Err: errors.New("address in use")}
+	}
+	l := &memListener{
+		m:      m,
+		addr:   h.addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.listeners[h.Addr()] = l
+	return l, nil
+}
+
+// Dial connects to the listener at addr.
+func (h *Host) Dial(addr string) (net.Conn, error) {
+	m := h.m
+	m.mu.Lock()
+	l := m.listeners[addr]
+	m.mu.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errRefused}
+	}
+	if m.cut(h.Addr(), addr) {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errUnreachable}
+	}
+	a, b := m.pipe(h.addr, l.addr)
+	select {
+	case l.conns <- b:
+		return a, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errRefused}
+	}
+}
+
+var (
+	errRefused     = errors.New("connection refused")
+	errUnreachable = errors.New("network is unreachable")
+)
+
+// pipe returns the two ends of a connection from host a to host b.
+func (m *Memory) pipe(a, b memAddr) (*memConn, *memConn) {
+	ab, ba := newQueue(m), newQueue(m)
+	ca := &memConn{m: m, local: a, remote: b, in: ba, out: ab, rand: m.rand(a, b)}
+	cb := &memConn{m: m, local: b, remote: a, in: ab, out: ba, rand: m.rand(b, a)}
+	return ca, cb
+}
+
+// rand returns the random source deciding which packets from a to b are lost.
+func (m *Memory) rand(a, b memAddr) *rand.Rand {
+	h := fnv.New64a()
+	io.WriteString(h, string(a)+">"+string(b))
+	m.mu.Lock()
+	seed := m.seed
+	m.mu.Unlock()
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+type memListener struct {
+	m      *Memory
+	addr   memAddr
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.m.mu.Lock()
+		delete(l.m.listeners, l.addr.String())
+		l.m.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return l.addr }
+
+// packet is the data of a Write.
+type packet struct {
+	data    []byte
+	arrived bool // the latency has passed, and the reader may read it
+}
+
+// queue carries the packets written on one end of a connection to the
+// other end.
+type queue struct {
+	m        *Memory
+	mu       sync.Mutex
+	cond     *sync.Cond
+	packets  []*packet
+	buf      []byte // rest of the packet being read
+	eof      bool   // the writer closed its end
+	closed   bool   // the reader closed its end
+	deadline time.Time
+}
+
+func newQueue(m *Memory) *queue {
+	q := &queue{m: m}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue) wake() {
+	q.mu.Lock()
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// push queues p, which arrives once latency has passed.
+func (q *queue) push(p *packet, latency time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.eof || q.closed {
+		return net.ErrClosed
+	}
+	atomic.AddInt64(&q.m.pending, 1)
+	q.packets = append(q.packets, p)
+	if latency <= 0 {
+		q.arrive(p)
+	} else {
+		q.m.clock.AfterFunc(latency, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if !q.closed {
+				q.arrive(p)
+			}
+		})
+	}
+	return nil
+}
+
+// arrive lets the reader read p. The caller must hold q.mu.
+func (q *queue) arrive(p *packet) {
+	p.arrived = true
+	atomic.AddInt64(&q.m.arrived, 1)
+	q.cond.Broadcast()
+}
+
+func (q *queue) read(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		switch {
+		case q.closed:
+			return 0, net.ErrClosed
+		case len(q.buf) > 0:
+			n := copy(b, q.buf)
+			q.buf = q.buf[n:]
+			return n, nil
+		case !q.deadline.IsZero() && !time.Now().Before(q.deadline):
+			return 0, os.ErrDeadlineExceeded
+		case len(q.packets) > 0:
+			// Packets arrive in the order they were written.
+			if p := q.packets[0]; p.arrived {
+				q.packets = q.packets[1:]
+				q.buf = p.data
+				atomic.AddInt64(&q.m.pending, -1)
+				q.m.read()
+				continue
+			}
+		case q.eof:
+			return 0, io.EOF
+		}
+		q.cond.Wait()
+	}
+}
+
+// close closes the queue for the reader or, if eof is set, the writer.
+func (q *queue) close(eof bool) {
+	q.mu.Lock()
+	if eof {
+		q.eof = true
+	} else {
+		q.closed = true
+		atomic.AddInt64(&q.m.pending, -int64(len(q.packets)))
+		for _, p := range q.packets {
+			if p.arrived {
+				q.m.read()
+			}
+		}
+		q.packets = nil
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// setDeadline sets the read deadline, which is measured on the real clock
+// like those of other connections.
+func (q *queue) setDeadline(t time.Time) {
+	q.mu.Lock()
+	q.deadline = t
+	q.mu.Unlock()
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), q.wake)
+	}
+	q.wake()
+}
+
+// memConn is one end of a connection on a Memory network.
+type memConn struct {
+	m             *Memory
+	local, remote memAddr
+	in, out       *queue
+	once          sync.Once
+
+	mu   sync.Mutex // guards rand
+	rand *rand.Rand
+}
+
+func (c *memConn) Read(b []byte) (int, error) { return c.in.read(b) }
+
+func (c *memConn) Write(b []byte) (int, error) {
+	m := c.m
+	m.mu.Lock()
+	latency, loss := m.latency, m.loss
+	m.mu.Unlock()
+	c.mu.Lock()
+	lost := loss > 0 && c.rand.Float64() < loss
+	c.mu.Unlock()
+	if lost || m.cut(string(c.local), string(c.remote)) {
+		return len(b), nil
+	}
+	p := &packet{data: append([]byte(nil), b...)}
+	if err := c.out.push(p, latency); err != nil {
+		return 0, &net.OpError{Op: "write", Net: "mem", Addr: c.remote, Err: err}
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		c.out.close(true)
+		c.in.close(false)
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	l, err := m.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, c.RemoteAddr().String())
+	}()
+
+	c, err := m.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), c.LocalAddr().String(); got != want {
+		t.Errorf("acceptor saw the dialer at %q, want %q", got, want)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept succeeded on a closed listener")
+	}
+	if _, err := m.Dial(l.Addr().String()); err == nil {
+		t.Error("Dial succeeded to a closed listener")
+	}
+}
+
+// connect returns the two ends of a connection between new hosts a and b.
+func connect(t *testing.T, m *Memory) (a, b *Host, ca, cb net.Conn) {
+	a, b = m.Host(), m.Host()
+	l, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	ca, err = a.Dial(b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, ca, <-accepted
+}
+
+func TestMemoryLatency(t *testing.T) {
+	clock := NewFakeClock()
+	m := NewMemoryClock(clock)
+	m.SetLatency(50 * time.Millisecond)
+	_, _, ca, cb := connect(t, m)
+
+	io.WriteString(ca, "ping")
+	got := make(chan string)
+	go func() {
+		b := make([]byte, 4)
+		io.ReadFull(cb, b)
+		got <- string(b)
+	}()
+	clock.Advance(49 * time.Millisecond)
+	m.Settle()
+	if n := m.Pending(); n != 1 {
+		t.Fatalf("Pending() = %d before the latency passed, want 1", n)
+	}
+	clock.Advance(time.Millisecond)
+	m.Settle()
+	if n := m.Pending(); n != 0 {
+		t.Errorf("Pending() = %d after Settle, want 0", n)
+	}
+	if s := <-got; s != "ping" {
+		t.Errorf("read %q, want ping", s)
+	}
+}
+
+func TestMemoryLoss(t *testing.T) {
+	received := func() []string {
+		m := NewMemory()
+		m.SetLoss(0.5, 42)
+		_, _, ca, cb := connect(t, m)
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(ca, "%d\n", i)
+		}
+		ca.Close()
+		var l []string
+		s := bufio.NewScanner(cb)
+		for s.Scan() {
+			l = append(l, s.Text())
+		}
+		return l
+	}
+	a, b := received(), received()
+	if len(a) < 30 || len(a) > 70 {
+		t.Errorf("received %d of 100 packets with loss 0.5", len(a))
+	}
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("lost different packets with the same seed:\n%v\n%v", a, b)
+	}
+}
+
+func TestMemoryPartition(t *testing.T) {
+	m := NewMemory()
+	a, b, ca, cb := connect(t, m)
+	m.Partition([]string{a.Addr()}, []string{b.Addr()})
+	io.WriteString(ca, "lost")
+	if _, err := a.Dial(b.Addr()); err == nil {
+		t.Error("Dial across a partition succeeded")
+	}
+	m.Heal()
+	io.WriteString(ca, "found")
+	b5 := make([]byte, 5)
+	if _, err := io.ReadFull(cb, b5); err != nil || string(b5) != "found" {
+		t.Errorf("read %q, %v; want found", b5, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Package transport provides the ways peers can connect to each other: plain
+// TCP, the multiplexing proxy of the proxy package, and an in-memory network
+// for running many peers in one process.
+package transport
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/campoy/whispering-gophers/proxy"
+	"github.com/campoy/whispering-gophers/util"
+)
+
+// A Transport makes connections between peers. Addresses are opaque strings
+// made by the Listen method of the same Transport.
+type Transport interface {
+	// Dial opens a connection to the peer listening on addr.
+	Dial(addr string) (net.Conn, error)
+	// Listen opens a listener whose Addr peers can Dial.
+	Listen() (net.Listener, error)
+}
+
+// Names of the transports accepted by New.
+const (
+	NameTCP    = "tcp"
+	NameProxy  = "proxy"
+	NameMemory = "mem"
+)
+
+// Names lists the transports accepted by New.
+var Names = []string{NameTCP, NameProxy, NameMemory}
+
+// Remote lists the transports that reach peers in other processes, which
+// are the ones accepted by NewRemote, for flag descriptions.
+var Remote = []string{NameTCP, NameProxy}
+
+// TCP connects peers with plain TCP, listening on the first non-loopback
+// IPv4 address of the machine, as the code lab does.
+var TCP Transport = tcp{}
+
+type tcp struct{}
+
+func (tcp) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+func (tcp) Listen() (net.Listener, error)      { return util.Listen() }
+
+// Proxy connects peers through the proxy service named by the -proxy flag.
+var Proxy Transport = proxyTransport{}
+
+type proxyTransport struct{}
+
+func (proxyTransport) Dial(addr string) (net.Conn, error) { return proxy.Dial(addr) }
+func (proxyTransport) Listen() (net.Listener, error)      { return proxy.Listen() }
+
+// New returns the transport with the given name. Each call for NameMemory
+// returns a new, empty network.
+func New(name string) (Transport, error) {
+	switch name {
+	case NameTCP:
+		return TCP, nil
+	case NameProxy:
+		return Proxy, nil
+	case NameMemory:
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// NewRemote is like New, but only accepts the transports in Remote. Commands
+// use it for their -transport flag: a network of their own in memory couldn't
+// reach any other node.
+func NewRemote(name string) (Transport, error) {
+	if name == NameMemory {
+		return nil, fmt.Errorf("transport %q only connects nodes in the same process", name)
+	}
+	return New(name)
+}
@@ -0,0 +1,16 @@
+package transport
+
+import "testing"
+
+func TestNewRemote(t *testing.T) {
+	for _, name := range Remote {
+		if _, err := NewRemote(name); err != nil {
+			t.Errorf("NewRemote(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{NameMemory, "carrier-pigeon"} {
+		if _, err := NewRemote(name); err == nil {
+			t.Errorf("NewRemote(%q) succeeded, want an error", name)
+		}
+	}
+}
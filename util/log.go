@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Keys of the log attributes shared by every component.
+const (
+	LogPeer   = "peer"   // address of the other end of a connection
+	LogDir    = "dir"    // direction of a connection: "in" if accepted, "out" if dialled
+	LogID     = "id"     // ID of a message
+	LogOrigin = "origin" // address of the node that sent a message first
+	LogErr    = "err"
+)
+
+// Directions of a connection, for LogDir.
+const (
+	DirIn  = "in"
+	DirOut = "out"
+)
+
+// LogLevels and LogFormats list the values accepted by NewLogger.
+var (
+	LogLevels  = []string{"debug", "info", "warn", "error"}
+	LogFormats = []string{"text", "json"}
+)
+
+// ParseLogLevel returns the level named by s, one of LogLevels.
+func ParseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// NewLogger returns a logger that writes records of the given level and
+// above to w, as text or JSON. Pass a *slog.LevelVar to change the level
+// later.
+func NewLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}